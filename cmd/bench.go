@@ -0,0 +1,214 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+// benchRunAttr tags the messages of one bench run, so messages already on
+// the subscription aren't counted.
+const benchRunAttr = "bench-run"
+
+var (
+	benchCount   int
+	benchBatch   int
+	benchCleanup bool
+	benchTimeout time.Duration
+)
+
+// benchPublish publishes count messages tagged with run to topic in batches
+// of batch and returns the number successfully published.
+func benchPublish(ctx context.Context, topic *pubsub.Topic, run string, count, batch int) int {
+	published := 0
+	msgs := make([]*pubsub.Message, 0, batch)
+	for i := 0; i < count && ctx.Err() == nil; i++ {
+		msgs = append(msgs, &pubsub.Message{
+			Data:       []byte(fmt.Sprintf("bench %d", i)),
+			Attributes: map[string]string{benchRunAttr: run},
+		})
+		if len(msgs) < batch && i < count-1 {
+			continue
+		}
+		ids, err := topic.Publish(ctx, msgs...)
+		if err != nil {
+			log.Errorf("error publishing: %v", err)
+		}
+		published += len(ids)
+		msgs = msgs[:0]
+	}
+	return published
+}
+
+// benchConsume pulls messages from sub, acking those tagged with run, until
+// want of them have been consumed, timeout has passed or ctx is cancelled,
+// and returns the number consumed. Other messages are left on sub.
+func benchConsume(ctx context.Context, sub *pubsub.Subscription, run string, want int, timeout time.Duration) int {
+	// The iterator has its own context so acks are still sent once ctx is
+	// cancelled; stopping it ends the pull in flight.
+	it, err := sub.Pull(context.Background(), pubsub.MaxExtension(time.Minute*1))
+	if err != nil {
+		log.Errorf("error creating pubsub iterator: %v", err)
+		return 0
+	}
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	stopped := make(chan struct{})
+	go func() {
+		<-cctx.Done()
+		it.Stop()
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	consumed, other := 0, 0
+	for consumed < want {
+		m, err := it.Next()
+		if err != nil {
+			if cctx.Err() != nil || err == pubsub.Done {
+				break
+			}
+			log.Errorf("error reading from iterator: %v", err)
+			continue
+		}
+		if m.Attributes[benchRunAttr] != run {
+			other++
+			m.Done(false)
+			continue
+		}
+		m.Done(true)
+		consumed++
+	}
+	if other > 0 {
+		log.Infof("Skipped %d messages from outside the benchmark", other)
+	}
+	if consumed < want {
+		log.Warnf("Consumed %d of %d messages within %v", consumed, want, timeout)
+	}
+	return consumed
+}
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Publish then consume messages, reporting throughput",
+	Long: `Publishes --count messages to the topic then consumes them from the
+subscription, reporting publish rate, consume rate and end-to-end time.
+Only messages published by the run are consumed and counted, for up to
+--consume-timeout.
+The topic and subscription are created if they don't exist; --cleanup
+deletes any resources created by the benchmark when it completes.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+
+		if Gceproject == "" || Topic == "" || subscription == "" {
+			log.Errorf("GCE project, subscription, and topic must be defined")
+			os.Exit(1)
+		}
+		if benchBatch < 1 || benchBatch > pubsub.MaxPublishBatchSize {
+			log.Errorf("batch must be between 1 and %d", pubsub.MaxPublishBatchSize)
+			os.Exit(1)
+		}
+		if benchTimeout <= 0 {
+			log.Errorf("--consume-timeout must be positive")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+
+		// The subscription must exist before publishing to receive the messages.
+		topic := psClient.Topic(Topic)
+		ok, err := topic.Exists(ctx)
+		if err != nil {
+			log.Errorf("error checking topic %s: %v", Topic, err)
+			os.Exit(1)
+		}
+		createdTopic := false
+		if !ok {
+			if topic, err = psClient.NewTopic(ctx, Topic); err != nil {
+				log.Errorf("error creating topic %s: %v", Topic, err)
+				os.Exit(1)
+			}
+			log.Infof("Created topic %s", Topic)
+			createdTopic = true
+		}
+
+		sub := psClient.Subscription(subscription)
+		ok, err = sub.Exists(ctx)
+		if err != nil {
+			log.Errorf("error checking subscription %s: %v", subscription, err)
+			os.Exit(1)
+		}
+		createdSub := false
+		if !ok {
+			if sub, err = psClient.NewSubscription(ctx, subscription, topic, 0, nil); err != nil {
+				log.Errorf("error creating subscription %s: %v", subscription, err)
+				os.Exit(1)
+			}
+			log.Infof("Created subscription %s", subscription)
+			createdSub = true
+		}
+
+		run := uuid.New()
+		start := time.Now()
+		published := benchPublish(ctx, topic, run, benchCount, benchBatch)
+		pubDur := time.Since(start)
+
+		consStart := time.Now()
+		consumed := benchConsume(ctx, sub, run, published, benchTimeout)
+		consDur := time.Since(consStart)
+		total := time.Since(start)
+
+		log.Infof("Published %d in %v: %f msgs/s", published, pubDur, float64(published)/pubDur.Seconds())
+		log.Infof("Consumed %d in %v: %f msgs/s", consumed, consDur, float64(consumed)/consDur.Seconds())
+		log.Infof("End-to-end %d of %d in %v", consumed, benchCount, total)
+
+		if benchCleanup {
+			// Use a fresh context so cleanup still happens after a signal.
+			cctx := context.Background()
+			if createdSub {
+				if err := sub.Delete(cctx); err != nil {
+					log.Errorf("error deleting subscription %s: %v", subscription, err)
+				}
+			}
+			if createdTopic {
+				if err := topic.Delete(cctx); err != nil {
+					log.Errorf("error deleting topic %s: %v", Topic, err)
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+
+	benchCmd.Flags().StringVar(&subscription, "sub", "", "PubSub subscription")
+	benchCmd.Flags().IntVar(&benchCount, "count", 1000, "Number of messages to publish and consume")
+	benchCmd.Flags().IntVar(&benchBatch, "batch", 100, "PubSub publishing batch sizes")
+	benchCmd.Flags().BoolVar(&benchCleanup, "cleanup", false, "Delete the topic and subscription if created by the benchmark")
+	benchCmd.Flags().DurationVar(&benchTimeout, "consume-timeout", time.Minute*5, "Longest to wait for the published messages to be consumed")
+}
@@ -0,0 +1,128 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/pborman/uuid"
+	"google.golang.org/cloud/pubsub"
+)
+
+// Attributes identifying the chunks of a payload split by pub --chunk.
+const (
+	chunkIDAttr    = "chunk-id"
+	chunkIndexAttr = "chunk-index"
+	chunkTotalAttr = "chunk-total"
+)
+
+// splitChunks splits m into messages of at most size bytes of data, each
+// carrying m's attributes plus the chunk attributes. Messages which fit are
+// returned whole.
+func splitChunks(m *pubsub.Message, size int) []*pubsub.Message {
+	if len(m.Data) <= size {
+		return []*pubsub.Message{m}
+	}
+	id := uuid.New()
+	total := (len(m.Data) + size - 1) / size
+	chunks := make([]*pubsub.Message, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(m.Data) {
+			end = len(m.Data)
+		}
+		attrs := make(map[string]string, len(m.Attributes)+3)
+		for k, v := range m.Attributes {
+			attrs[k] = v
+		}
+		attrs[chunkIDAttr] = id
+		attrs[chunkIndexAttr] = strconv.Itoa(i)
+		attrs[chunkTotalAttr] = strconv.Itoa(total)
+		chunks = append(chunks, &pubsub.Message{Data: m.Data[i*size : end], Attributes: attrs})
+	}
+	return chunks
+}
+
+// partialPayload collects the chunks of one payload as they arrive.
+type partialPayload struct {
+	chunks [][]byte
+	got    int
+	attrs  map[string]string
+}
+
+// reassembler rebuilds payloads split by pub --chunk from their chunks,
+// which may arrive in any order.
+type reassembler struct {
+	pending map[string]*partialPayload
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{pending: map[string]*partialPayload{}}
+}
+
+// Add adds m and returns the reassembled message once every chunk of its
+// payload has arrived, or nil while chunks are outstanding. Messages which
+// aren't chunks are returned as they are. The reassembled message's ID is
+// the chunk ID and its attributes are those of its chunks, less the chunk
+// attributes.
+func (r *reassembler) Add(m *pubsub.Message) (*pubsub.Message, error) {
+	id, ok := m.Attributes[chunkIDAttr]
+	if !ok {
+		return m, nil
+	}
+	index, err := strconv.Atoi(m.Attributes[chunkIndexAttr])
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s has invalid %s: %v", m.ID, chunkIndexAttr, err)
+	}
+	total, err := strconv.Atoi(m.Attributes[chunkTotalAttr])
+	if err != nil || total < 1 {
+		return nil, fmt.Errorf("chunk %s has invalid %s %q", m.ID, chunkTotalAttr, m.Attributes[chunkTotalAttr])
+	}
+	if index < 0 || index >= total {
+		return nil, fmt.Errorf("chunk %s index %d out of range of %d", m.ID, index, total)
+	}
+
+	p := r.pending[id]
+	if p == nil {
+		p = &partialPayload{chunks: make([][]byte, total), attrs: map[string]string{}}
+		for k, v := range m.Attributes {
+			if k != chunkIDAttr && k != chunkIndexAttr && k != chunkTotalAttr {
+				p.attrs[k] = v
+			}
+		}
+		r.pending[id] = p
+	}
+	if len(p.chunks) != total {
+		return nil, fmt.Errorf("chunk %s of %s says %d chunks, earlier chunks said %d", m.ID, id, total, len(p.chunks))
+	}
+	if p.chunks[index] != nil {
+		// A redelivered chunk.
+		return nil, nil
+	}
+	p.chunks[index] = m.Data
+	if p.got++; p.got < total {
+		return nil, nil
+	}
+
+	delete(r.pending, id)
+	return &pubsub.Message{ID: id, Data: bytes.Join(p.chunks, nil), Attributes: p.attrs}, nil
+}
+
+// Pending returns the number of payloads still missing chunks.
+func (r *reassembler) Pending() int {
+	return len(r.pending)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"google.golang.org/cloud/pubsub"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	defer func(attr string, seq int64, from string) {
+		sequenceAttr, sequence, dedupKeyFrom = attr, seq, from
+	}(sequenceAttr, sequence, dedupKeyFrom)
+	sequenceAttr, sequence, dedupKeyFrom = "seq", 0, "sha256"
+
+	s, err := newSigner("key", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(ps *signer) { pubSigner = ps }(pubSigner)
+	pubSigner = s
+
+	data := []byte("a payload of more than one chunk")
+	msg, err := newMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := chunkMessage(msg, 8)
+	if len(chunks) != 4 {
+		t.Fatalf("got %d chunks, want 4", len(chunks))
+	}
+	keys := map[string]bool{}
+	for _, c := range chunks {
+		keys[c.Attributes[dedupAttr]] = true
+	}
+	if len(keys) != len(chunks) {
+		t.Errorf("chunks share dedup keys: %v", keys)
+	}
+
+	// Deliver out of order, with a chunk redelivered before the payload
+	// completes and another after.
+	delivery := []*pubsub.Message{chunks[2], chunks[0], chunks[2], chunks[3], chunks[1], chunks[0]}
+	f := &messageFilter{verifier: s, seqs: newSequenceWindow("seq", 100), reassembling: true}
+	r := newReassembler()
+	var got []*pubsub.Message
+	for i, c := range delivery {
+		if v := f.Check(c, time.Now()); v != accepted {
+			if v != duplicate || i != 2 && i != 5 {
+				t.Fatalf("delivery %d: Check = %v", i, v)
+			}
+			continue
+		}
+		m, err := r.Add(c)
+		if err != nil {
+			t.Fatalf("delivery %d: Add: %v", i, err)
+		}
+		if m != nil {
+			got = append(got, m)
+		}
+	}
+	if len(got) != 1 {
+		t.Fatalf("reassembled %d payloads, want 1", len(got))
+	}
+	if !bytes.Equal(got[0].Data, data) {
+		t.Errorf("reassembled %q, want %q", got[0].Data, data)
+	}
+	if err := s.Verify(got[0]); err != nil {
+		t.Errorf("reassembled payload: %v", err)
+	}
+	if r.Pending() != 0 {
+		t.Errorf("%d payloads pending, want 0", r.Pending())
+	}
+}
+
+func TestChunkMessageFits(t *testing.T) {
+	defer func(attr string, seq int64) {
+		sequenceAttr, sequence = attr, seq
+	}(sequenceAttr, sequence)
+	sequenceAttr, sequence = "seq", 0
+
+	msg, err := newMessage([]byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := chunkMessage(msg, 8)
+	if len(chunks) != 1 || chunks[0] != msg {
+		t.Fatalf("chunkMessage split a message that fits into %d", len(chunks))
+	}
+	if sequence != 1 {
+		t.Errorf("sequence = %d, want 1", sequence)
+	}
+}
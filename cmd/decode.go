@@ -0,0 +1,72 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"google.golang.org/cloud/pubsub"
+)
+
+// decodingWriter writes messages with their data decoded according to
+// their content encoding attribute, leaving the consumed message untouched.
+// Data which can't be decoded is written raw with a warning.
+type decodingWriter struct {
+	messageWriter
+	// warned records the unknown encodings already warned about.
+	warned map[string]bool
+}
+
+func newDecodingWriter(mw messageWriter) *decodingWriter {
+	return &decodingWriter{messageWriter: mw, warned: map[string]bool{}}
+}
+
+func (dw *decodingWriter) Write(m *pubsub.Message) error {
+	enc := strings.ToLower(m.Attributes[decodeEncodingAttr])
+	var data []byte
+	var err error
+	switch enc {
+	case "", "identity":
+		return dw.messageWriter.Write(m)
+	case "gzip":
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(m.Data)); err == nil {
+			data, err = ioutil.ReadAll(zr)
+		}
+	case "base64":
+		data, err = base64.StdEncoding.DecodeString(string(m.Data))
+	default:
+		if !dw.warned[enc] {
+			log.Warnf("unknown %s %q, writing raw data", decodeEncodingAttr, enc)
+			dw.warned[enc] = true
+		}
+		return dw.messageWriter.Write(m)
+	}
+	if err != nil {
+		log.Warnf("error decoding %s message %s, writing raw data: %v", enc, m.ID, err)
+		return dw.messageWriter.Write(m)
+	}
+	return dw.messageWriter.Write(&pubsub.Message{ID: m.ID, Data: data, Attributes: m.Attributes, AckID: m.AckID})
+}
+
+// isJSONMessage reports whether m's content type attribute names JSON.
+func isJSONMessage(m *pubsub.Message) bool {
+	return strings.Contains(strings.ToLower(m.Attributes[decodeTypeAttr]), "json")
+}
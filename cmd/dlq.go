@@ -0,0 +1,170 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+// dlqReasonAttr records why a message was dead-lettered and is stripped
+// when it is redriven.
+const dlqReasonAttr = "dlq-reason"
+
+var (
+	dlqSub     string
+	dlqToTopic string
+	dlqMax     int
+	dlqDryRun  bool
+)
+
+// releaseMessages sets the ack deadline of msgs to 0 so they are
+// redelivered straight away.
+func releaseMessages(gctx context.Context, sub string, msgs []*pubsub.Message) {
+	for _, m := range msgs {
+		if err := pubsub.ModifyAckDeadline(gctx, sub, m.AckID, 0); err != nil {
+			log.Warnf("error releasing message %s: %v", m.ID, err)
+		}
+	}
+}
+
+// redriveMessage returns a copy of m to republish, without dlq-reason.
+func redriveMessage(m *pubsub.Message) *pubsub.Message {
+	attrs := make(map[string]string, len(m.Attributes))
+	for k, v := range m.Attributes {
+		if k != dlqReasonAttr {
+			attrs[k] = v
+		}
+	}
+	if len(attrs) == 0 {
+		attrs = nil
+	}
+	return &pubsub.Message{Data: m.Data, Attributes: attrs}
+}
+
+// redrive republishes up to max of the messages available on the dead-letter
+// subscription sub to topic, acking each batch once it is published, and
+// returns the number redriven. With dryRun messages are only printed, and
+// released at the end so repeated pulls don't return them again.
+func redrive(gctx context.Context, sub string, topic *pubsub.Topic, max int, dryRun bool) (int, error) {
+	var held []*pubsub.Message
+	defer func() { releaseMessages(gctx, sub, held) }()
+
+	n := 0
+	for (max <= 0 || n < max) && rootCtx.Err() == nil {
+		batch := maxPullBatch
+		if max > 0 && max-n < batch {
+			batch = max - n
+		}
+		msgs, err := pubsub.Pull(gctx, sub, batch)
+		if err != nil {
+			return n, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+
+		if dryRun {
+			for _, m := range msgs {
+				fmt.Printf("would redrive %s (%s=%q)\n", m.ID, dlqReasonAttr, m.Attributes[dlqReasonAttr])
+			}
+			held = append(held, msgs...)
+			n += len(msgs)
+			continue
+		}
+
+		out := make([]*pubsub.Message, len(msgs))
+		ids := make([]string, len(msgs))
+		for i, m := range msgs {
+			out[i] = redriveMessage(m)
+			ids[i] = m.AckID
+		}
+		if _, err := topic.Publish(gctx, out...); err != nil {
+			releaseMessages(gctx, sub, msgs)
+			return n, fmt.Errorf("error republishing %d messages: %v", len(msgs), err)
+		}
+		if err := pubsub.Ack(gctx, sub, ids...); err != nil {
+			// They'll be redelivered and redriven again.
+			log.Errorf("error acking %d redriven messages: %v", len(ids), err)
+		}
+		n += len(msgs)
+	}
+	return n, nil
+}
+
+// dlqCmd represents the dlq command
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "Manage dead-letter subscriptions",
+	Long:  `Operate on the dead-letter subscriptions of a project.`,
+}
+
+// dlqRedriveCmd represents the dlq redrive command
+var dlqRedriveCmd = &cobra.Command{
+	Use:   "redrive",
+	Short: "Republish dead-lettered messages to their original topic",
+	Long: `Consume the messages available on --dlq-sub and republish them to --to-topic
+without their dlq-reason attribute. Each batch is acked only after it is
+republished, so a failure leaves messages on the dead-letter subscription.
+--dry-run prints what would be redriven and leaves it in place.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if Gceproject == "" || dlqSub == "" || dlqToTopic == "" {
+			log.Errorf("GCE project, --dlq-sub and --to-topic must be defined")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		topic := psClient.Topic(dlqToTopic)
+		ok, err := topic.Exists(ctx)
+		if err != nil {
+			log.Errorf("error checking topic %s: %v", dlqToTopic, err)
+			os.Exit(1)
+		}
+		if !ok {
+			log.Errorf("topic %s does not exist", dlqToTopic)
+			os.Exit(1)
+		}
+
+		// gctx isn't cancelled by signals, so in-flight batches finish.
+		gctx := legacyContext()
+		n, err := redrive(gctx, dlqSub, topic, dlqMax, dlqDryRun)
+		if dlqDryRun {
+			log.Infof("Would redrive %d messages from %s to %s", n, dlqSub, dlqToTopic)
+		} else {
+			log.Infof("Redrove %d messages from %s to %s", n, dlqSub, dlqToTopic)
+		}
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(dlqCmd)
+	dlqCmd.AddCommand(dlqRedriveCmd)
+
+	dlqRedriveCmd.Flags().StringVar(&dlqSub, "dlq-sub", "", "Dead-letter subscription to redrive from")
+	dlqRedriveCmd.Flags().StringVar(&dlqToTopic, "to-topic", "", "Topic to republish messages to")
+	dlqRedriveCmd.Flags().IntVar(&dlqMax, "max", 0, "Most messages to redrive; 0 redrives all available")
+	dlqRedriveCmd.Flags().BoolVar(&dlqDryRun, "dry-run", false, "Print the messages which would be redriven without moving them")
+}
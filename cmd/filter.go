@@ -0,0 +1,85 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"google.golang.org/cloud/pubsub"
+)
+
+// verdict is what a messageFilter decided about a message.
+type verdict int
+
+const (
+	accepted   verdict = iota // process the message
+	expired                   // --drop-expired: ack and skip it
+	unverified                // --verify-key failed: leave it for redelivery
+	duplicate                 // --sequence-attr replay: ack as usual, skip it
+)
+
+// messageFilter is the per-message pipeline every sub mode applies before
+// writing a message: --drop-expired, then --verify-key, then
+// --sequence-attr.
+type messageFilter struct {
+	dropExpired bool
+	verifier    *signer
+	seqs        *sequenceWindow
+	// reassembling skips verifying chunks, which carry the signature of
+	// their whole payload and are verified once reassembled. Only the
+	// streaming sub reassembles, so it's set there.
+	reassembling bool
+}
+
+// newMessageFilter returns the filter configured by the sub flags.
+func newMessageFilter(verifier *signer) *messageFilter {
+	f := &messageFilter{
+		dropExpired: dropExpired,
+		verifier:    verifier,
+	}
+	if subSequenceAttr != "" {
+		f.seqs = newSequenceWindow(subSequenceAttr, sequenceWindowSize)
+	}
+	return f
+}
+
+// Check returns the verdict on m at now, logging why it isn't accepted.
+func (f *messageFilter) Check(m *pubsub.Message, now time.Time) verdict {
+	if f.dropExpired && messageExpired(m, now) {
+		log.Debugf("dropping expired message %s", m.ID)
+		return expired
+	}
+	if f.verifier != nil && !(f.reassembling && m.Attributes[chunkIDAttr] != "") {
+		if err := f.verifier.Verify(m); err != nil {
+			log.Warnf("rejecting message: %v", err)
+			stats.Incr("verify.failures", 1)
+			return unverified
+		}
+	}
+	if f.seqs != nil && f.seqs.Duplicate(m) {
+		log.Debugf("dropping duplicate message %s", m.ID)
+		return duplicate
+	}
+	return accepted
+}
+
+// Forget undoes Check's record of m's sequence number, so a redelivery of
+// a message that wasn't processed isn't taken for a duplicate.
+func (f *messageFilter) Forget(m *pubsub.Message) {
+	if f.seqs != nil {
+		f.seqs.Forget(m)
+	}
+}
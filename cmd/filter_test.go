@@ -0,0 +1,96 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/cloud/pubsub"
+)
+
+func TestMessageFilter(t *testing.T) {
+	s, err := newSigner("key", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Minute).Format(time.RFC3339)
+	signed := func(data string, attrs map[string]string) *pubsub.Message {
+		m := &pubsub.Message{Data: []byte(data), Attributes: map[string]string{signatureAttr: s.Sign([]byte(data))}}
+		for k, v := range attrs {
+			m.Attributes[k] = v
+		}
+		return m
+	}
+	tampered := signed("payload", nil)
+	tampered.Data = []byte("pay1oad")
+
+	tests := []struct {
+		name   string
+		filter messageFilter
+		m      *pubsub.Message
+		want   verdict
+	}{
+		{"plain", messageFilter{}, &pubsub.Message{Data: []byte("x")}, accepted},
+		{"expired ignored", messageFilter{}, &pubsub.Message{Attributes: map[string]string{expiresAtAttr: past}}, accepted},
+		{"expired", messageFilter{dropExpired: true}, &pubsub.Message{Attributes: map[string]string{expiresAtAttr: past}}, expired},
+		{"signed", messageFilter{verifier: s}, signed("payload", nil), accepted},
+		{"tampered", messageFilter{verifier: s}, tampered, unverified},
+		{"unsigned", messageFilter{verifier: s}, &pubsub.Message{Data: []byte("payload")}, unverified},
+		{"unsigned chunk", messageFilter{verifier: s}, &pubsub.Message{Attributes: map[string]string{chunkIDAttr: "c"}}, unverified},
+		{"chunk reassembling", messageFilter{verifier: s, reassembling: true}, &pubsub.Message{Attributes: map[string]string{chunkIDAttr: "c"}}, accepted},
+		{"expired unsigned", messageFilter{dropExpired: true, verifier: s}, &pubsub.Message{Attributes: map[string]string{expiresAtAttr: past}}, expired},
+		{"expired signed", messageFilter{verifier: s, dropExpired: true}, signed("payload", map[string]string{expiresAtAttr: past}), expired},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Check(tt.m, now); got != tt.want {
+			t.Errorf("%s: Check = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMessageFilterSequence(t *testing.T) {
+	s, err := newSigner("key", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &messageFilter{verifier: s, seqs: newSequenceWindow("seq", 10)}
+	m := &pubsub.Message{Data: []byte("a"), Attributes: map[string]string{"seq": "1", signatureAttr: s.Sign([]byte("a"))}}
+	forged := &pubsub.Message{Data: []byte("b"), Attributes: map[string]string{"seq": "2"}}
+	now := time.Now()
+
+	steps := []struct {
+		m      *pubsub.Message
+		forget bool
+		want   verdict
+	}{
+		{m, false, accepted},
+		{m, false, duplicate},
+		{m, true, duplicate},
+		{m, false, accepted},
+		// Unverified messages don't take up their sequence number.
+		{forged, false, unverified},
+		{&pubsub.Message{Data: []byte("b"), Attributes: map[string]string{"seq": "2", signatureAttr: s.Sign([]byte("b"))}}, false, accepted},
+	}
+	for i, st := range steps {
+		if got := f.Check(st.m, now); got != st.want {
+			t.Errorf("step %d: Check = %v, want %v", i, got, st.want)
+		}
+		if st.forget {
+			f.Forget(st.m)
+		}
+	}
+}
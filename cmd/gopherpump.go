@@ -19,8 +19,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
@@ -36,8 +34,47 @@ var (
 	num          int
 	batchInt     int
 	httpendpoint string
+	flushTimeout time.Duration
 )
 
+// publisher publishes a batch of messages, as *pubsub.Topic does.
+type publisher interface {
+	Publish(ctx context.Context, msgs ...*pubsub.Message) ([]string, error)
+}
+
+// flushFinal publishes the final partial batch msgs, giving up after
+// timeout so shutdown can't hang on a publisher which ignores ctx. It
+// returns the number of messages lost.
+func flushFinal(ctx context.Context, p publisher, msgs []*pubsub.Message, timeout time.Duration) int {
+	if len(msgs) == 0 {
+		return 0
+	}
+	fctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	log.Infof("Flushing %d to %s", len(msgs), Topic)
+	type result struct {
+		ids []string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ids, err := p.Publish(fctx, msgs...)
+		done <- result{ids, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-fctx.Done():
+		r.err = fctx.Err()
+	}
+	if r.err != nil {
+		log.Errorf("error flushing, %d messages not published: %v", len(msgs), r.err)
+		return len(msgs)
+	}
+	log.Debugf("Message IDs\n%#v", r.ids)
+	return 0
+}
+
 // gopherpumpCmd represents the gopherpump command
 var gopherpumpCmd = &cobra.Command{
 	Use:   "gopherpump",
@@ -46,10 +83,7 @@ var gopherpumpCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		logsetup()
 		log.Debugf("gopherpump called: num: %d batch: %d http: %s", num, batchInt, httpendpoint)
-		// Listen for kill signals
-		quit := make(chan os.Signal, 1)
 		figureChan := make(chan *lg.Figure)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 		// ------------------------------------------------------------------
 		// Query LegendaryGopher API
@@ -85,7 +119,7 @@ var gopherpumpCmd = &cobra.Command{
 
 		// ------------------------------------------------------------------
 		// PubSub Pump
-		ctx := context.Background()
+		ctx := rootCtx
 		var psClient *pubsub.Client
 		if KeyPath != "" {
 			psClient = JWTClientInit(&ctx)
@@ -103,24 +137,29 @@ var gopherpumpCmd = &cobra.Command{
 		}
 		psHTTPClient := initClient()
 		gctx := cloud.NewContext(Gceproject, psHTTPClient)
+		if err := waitForTopicReady(ctx, psClient, Topic); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
 		topic := psClient.Topic(Topic)
 
 		// Write Figures to PubSub
 		i := 0
 		exit := false
 		msgs := make([]*pubsub.Message, 0)
+		bar := newProgressBar(num)
 		for exit == false && i < num {
 			select {
 			case f := <-figureChan:
 				i++
+				bar.Update(i)
 				log.Debugf("figure: %#v", *f)
 
 				attrs := map[string]string{"race": f.Race, "caste": f.Caste, "name": f.Name}
 
-				if len(msgs) < batchInt {
-					m := &pubsub.Message{Attributes: attrs, Data: []byte(f.Name)}
-					msgs = append(msgs, m)
-				} else {
+				m := &pubsub.Message{Attributes: attrs, Data: []byte(f.Name)}
+				msgs = append(msgs, m)
+				if len(msgs) >= batchInt {
 					log.Infof("Publishing %d to %s", len(msgs), Topic)
 					ids, err := topic.Publish(gctx, msgs...)
 					if err != nil {
@@ -132,11 +171,14 @@ var gopherpumpCmd = &cobra.Command{
 
 			case <-time.After(time.Second * 1):
 				log.Debugf("publisher heartbeat")
-			case <-quit:
-				log.Warnf("quit signal caught")
+			case <-ctx.Done():
 				exit = true
 			}
 		}
+
+		bar.Done()
+
+		flushFinal(gctx, topic, msgs, flushTimeout)
 		log.Infof("Figures: %d", i)
 	},
 }
@@ -146,5 +188,6 @@ func init() {
 
 	gopherpumpCmd.Flags().IntVar(&num, "num", 100, "Number of entities to write to pubsub")
 	gopherpumpCmd.Flags().IntVar(&batchInt, "batch", 50, "PubSub publishing batch sizes")
+	gopherpumpCmd.Flags().DurationVar(&flushTimeout, "flush-timeout", 10*time.Second, "Maximum time to wait for pending messages to publish on exit")
 	gopherpumpCmd.Flags().StringVar(&httpendpoint, "figures", "http://localhost:6565/api/figures", "JSON API endpoint to read figure definitions from")
 }
@@ -0,0 +1,63 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+// slowPublisher takes delay to publish, ignoring its context.
+type slowPublisher struct {
+	delay time.Duration
+}
+
+func (p slowPublisher) Publish(ctx context.Context, msgs ...*pubsub.Message) ([]string, error) {
+	time.Sleep(p.delay)
+	return make([]string, len(msgs)), nil
+}
+
+func TestFlushFinal(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.StandardLogger().Out)
+	log.SetOutput(&buf)
+
+	msgs := []*pubsub.Message{{Data: []byte("a")}, {Data: []byte("b")}, {Data: []byte("c")}}
+	timeout := 50 * time.Millisecond
+
+	start := time.Now()
+	if lost := flushFinal(context.Background(), slowPublisher{time.Second}, msgs, timeout); lost != 3 {
+		t.Errorf("slow publisher: flushFinal lost %d, want 3", lost)
+	}
+	if d := time.Since(start); d >= 500*time.Millisecond {
+		t.Errorf("slow publisher: flushFinal returned after %v with --flush-timeout=%v", d, timeout)
+	}
+	if !strings.Contains(buf.String(), "3 messages not published") {
+		t.Errorf("slow publisher: lost messages not logged: %s", buf.String())
+	}
+
+	if lost := flushFinal(context.Background(), slowPublisher{}, msgs, timeout); lost != 0 {
+		t.Errorf("fast publisher: flushFinal lost %d, want 0", lost)
+	}
+	if lost := flushFinal(context.Background(), slowPublisher{time.Second}, nil, timeout); lost != 0 {
+		t.Errorf("no messages: flushFinal lost %d, want 0", lost)
+	}
+}
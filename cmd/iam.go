@@ -0,0 +1,124 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/pubsub/v1"
+)
+
+var (
+	iamResource    string
+	iamName        string
+	iamPermissions []string
+	iamOutput      string
+)
+
+// iamPermission is one row of the iam test report.
+type iamPermission struct {
+	Permission string `json:"permission"`
+	Granted    bool   `json:"granted"`
+}
+
+// testIamPermissions reports which of perms the current identity holds on
+// the named topic or subscription, in the order requested.
+func testIamPermissions(resource, name string, perms []string) ([]iamPermission, error) {
+	c, err := pubsub.New(httpClientInit())
+	if err != nil {
+		return nil, err
+	}
+
+	req := &pubsub.TestIamPermissionsRequest{Permissions: perms}
+	var resp *pubsub.TestIamPermissionsResponse
+	switch resource {
+	case "topic":
+		full := fmt.Sprintf("projects/%s/topics/%s", Gceproject, name)
+		resp, err = c.Projects.Topics.TestIamPermissions(full, req).Context(rootCtx).Do()
+	case "sub":
+		full := fmt.Sprintf("projects/%s/subscriptions/%s", Gceproject, name)
+		resp, err = c.Projects.Subscriptions.TestIamPermissions(full, req).Context(rootCtx).Do()
+	default:
+		return nil, fmt.Errorf("unknown resource type: %s", resource)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	granted := make(map[string]bool, len(resp.Permissions))
+	for _, p := range resp.Permissions {
+		granted[p] = true
+	}
+	report := make([]iamPermission, len(perms))
+	for i, p := range perms {
+		report[i] = iamPermission{Permission: p, Granted: granted[p]}
+	}
+	return report, nil
+}
+
+// iamCmd represents the iam command
+var iamCmd = &cobra.Command{
+	Use:   "iam",
+	Short: "Inspect IAM permissions",
+	Long:  `Inspect the IAM permissions of the current identity on topics and subscriptions.`,
+}
+
+// iamTestCmd represents the iam test command
+var iamTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Report which permissions the current identity holds",
+	Long: `Calls TestIamPermissions on a topic or subscription and reports which of the
+requested permissions the current identity holds, eg:
+
+  pubbing iam test --resource topic --name t --permissions pubsub.topics.publish`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if iamName == "" || len(iamPermissions) == 0 {
+			log.Errorf("--name and --permissions must be defined")
+			os.Exit(1)
+		}
+
+		report, err := testIamPermissions(iamResource, iamName, iamPermissions)
+		if err != nil {
+			log.Errorf("error testing permissions on %s %s: %v", iamResource, iamName, err)
+			os.Exit(1)
+		}
+
+		if iamOutput == "json" {
+			printJSON(report)
+			return
+		}
+		for _, p := range report {
+			granted := "no"
+			if p.Granted {
+				granted = "yes"
+			}
+			fmt.Printf("%-40s %s\n", p.Permission, granted)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(iamCmd)
+	iamCmd.AddCommand(iamTestCmd)
+
+	iamTestCmd.Flags().StringVar(&iamResource, "resource", "topic", "resource type: topic,sub")
+	iamTestCmd.Flags().StringVar(&iamName, "name", "", "name of the topic or subscription")
+	iamTestCmd.Flags().StringSliceVar(&iamPermissions, "permissions", nil, "permissions to test, eg: pubsub.topics.publish,pubsub.subscriptions.consume")
+	iamTestCmd.Flags().StringVar(&iamOutput, "output", "text", "output format: text,json")
+}
@@ -0,0 +1,139 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonAttr sets attribute key to the scalar found at path in a JSON payload.
+// path holds object keys as strings and array indexes as ints.
+type jsonAttr struct {
+	key  string
+	path []interface{}
+}
+
+// parseJSONAttr parses a --attr-from-json rule of the form key=$.path.
+func parseJSONAttr(spec string) (jsonAttr, error) {
+	i := strings.Index(spec, "=")
+	if i < 1 {
+		return jsonAttr{}, fmt.Errorf("invalid --attr-from-json %q: want key=$.path", spec)
+	}
+	path, err := parseJSONPath(spec[i+1:])
+	if err != nil {
+		return jsonAttr{}, fmt.Errorf("invalid --attr-from-json %q: %v", spec, err)
+	}
+	return jsonAttr{key: spec[:i], path: path}, nil
+}
+
+// parseJSONPath parses the subset of JSONPath made of $ followed by .name
+// and [index] steps, eg: $.order.items[0].sku.
+func parseJSONPath(p string) ([]interface{}, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("path %q must start with $", p)
+	}
+	var path []interface{}
+	rest := p[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("path %q has an empty key", p)
+			}
+			path = append(path, name)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unclosed [", p)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("path %q has an invalid index %q", p, rest[1:end])
+			}
+			path = append(path, n)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path %q: unexpected %q", p, rest[0])
+		}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("path %q selects the whole document", p)
+	}
+	return path, nil
+}
+
+// extract returns the scalar at a's path in v as a string. Missing keys and
+// objects, arrays or null at the path are errors.
+func (a jsonAttr) extract(v interface{}) (string, error) {
+	for _, step := range a.path {
+		switch s := step.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("%s: %q is not in an object", a.key, s)
+			}
+			if v, ok = obj[s]; !ok {
+				return "", fmt.Errorf("%s: key %q not found", a.key, s)
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || s >= len(arr) {
+				return "", fmt.Errorf("%s: index %d not found", a.key, s)
+			}
+			v = arr[s]
+		}
+	}
+
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case json.Number:
+		return s.String(), nil
+	case bool:
+		return strconv.FormatBool(s), nil
+	}
+	return "", fmt.Errorf("%s: value is not a string, number or bool", a.key)
+}
+
+// jsonAttributes extracts each of attrs from the JSON payload data.
+func jsonAttributes(attrs []jsonAttr, data []byte) (map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as written rather than round tripping through float64.
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("payload is not JSON: %v", err)
+	}
+
+	values := make(map[string]string, len(attrs))
+	for _, a := range attrs {
+		s, err := a.extract(v)
+		if err != nil {
+			return nil, err
+		}
+		values[a.key] = s
+	}
+	return values, nil
+}
@@ -0,0 +1,92 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONAttr(t *testing.T) {
+	tests := []struct {
+		spec    string
+		key     string
+		path    []interface{}
+		wantErr bool
+	}{
+		{"sku=$.sku", "sku", []interface{}{"sku"}, false},
+		{"sku=$.order.items[0].sku", "sku", []interface{}{"order", "items", 0, "sku"}, false},
+		{"first=$[0]", "first", []interface{}{0}, false},
+		{"cell=$.grid[1][2]", "cell", []interface{}{"grid", 1, 2}, false},
+		{"a=b=$.x", "", nil, true},
+		{"=$.sku", "", nil, true},
+		{"sku", "", nil, true},
+		{"sku=.sku", "", nil, true},
+		{"sku=$", "", nil, true},
+		{"sku=$.", "", nil, true},
+		{"sku=$..sku", "", nil, true},
+		{"sku=$.items[", "", nil, true},
+		{"sku=$.items[x]", "", nil, true},
+		{"sku=$.items[-1]", "", nil, true},
+		{"sku=$sku", "", nil, true},
+	}
+	for _, tt := range tests {
+		a, err := parseJSONAttr(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseJSONAttr(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (a.key != tt.key || !reflect.DeepEqual(a.path, tt.path)) {
+			t.Errorf("parseJSONAttr(%q) = %q %v, want %q %v", tt.spec, a.key, a.path, tt.key, tt.path)
+		}
+	}
+}
+
+func TestJSONAttributes(t *testing.T) {
+	const doc = `{"order": {"id": 12345678901234567890, "paid": true, "note": null,
+		"items": [{"sku": "A1"}, {"sku": "B2", "tags": ["x"]}]}}`
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"v=$.order.items[1].sku", "B2", false},
+		{"v=$.order.items[1].tags[0]", "x", false},
+		{"v=$.order.id", "12345678901234567890", false},
+		{"v=$.order.paid", "true", false},
+		{"v=$.order.missing", "", true},
+		{"v=$.order.items[2].sku", "", true},
+		{"v=$.order.items.sku", "", true},
+		{"v=$.order[0]", "", true},
+		{"v=$.order.note", "", true},
+		{"v=$.order.items", "", true},
+		{"v=$.order", "", true},
+	}
+	for _, tt := range tests {
+		a, err := parseJSONAttr(tt.spec)
+		if err != nil {
+			t.Fatalf("parseJSONAttr(%q): %v", tt.spec, err)
+		}
+		got, err := jsonAttributes([]jsonAttr{a}, []byte(doc))
+		if (err != nil) != tt.wantErr || got["v"] != tt.want {
+			t.Errorf("%s: jsonAttributes = %v, %v, want %q, error %v", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	a, _ := parseJSONAttr("v=$.a")
+	if _, err := jsonAttributes([]jsonAttr{a}, []byte("not json")); err == nil {
+		t.Error("jsonAttributes of a non-JSON payload succeeded")
+	}
+}
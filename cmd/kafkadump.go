@@ -0,0 +1,167 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// kafkaKeyAttr holds the record key of messages published from a Kafka dump.
+const kafkaKeyAttr = "kafka-key"
+
+// kafkaRecord is one record of a Kafka dump.
+type kafkaRecord struct {
+	line    int // line the record starts on
+	key     string
+	headers map[string]string
+	value   string
+}
+
+// maxKafkaValue is the longest line accepted in a Kafka dump.
+const maxKafkaValue = 10 * 1024 * 1024
+
+// kafkaRecordResult is a parsed record or the error parsing it.
+type kafkaRecordResult struct {
+	rec *kafkaRecord
+	err error
+}
+
+// readKafkaDump sends each record of a Kafka dump read from r on the
+// returned channel. A dump is a series of records separated by lines holding
+// only ---. Each record has header lines, a blank line, then its value:
+//
+//	key: user-42
+//	header: source=orders
+//	header: trace-id=abc123
+//
+//	{"order": 1}
+//	---
+//
+// The key line is optional, header lines are name=value and become message
+// attributes, and the value, without its final newline, becomes the data.
+// Records which fail to parse are sent with err set. Reading stops early
+// once done is closed.
+func readKafkaDump(r io.Reader, done <-chan struct{}) <-chan kafkaRecordResult {
+	results := make(chan kafkaRecordResult)
+	go func() {
+		defer close(results)
+		send := func(res kafkaRecordResult) bool {
+			select {
+			case results <- res:
+				return true
+			case <-done:
+				return false
+			}
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), maxKafkaValue)
+		n := 0
+		var block []string
+		start := 1
+		flush := func() bool {
+			ok := true
+			if len(block) > 0 {
+				rec, err := parseKafkaRecord(start, block)
+				ok = send(kafkaRecordResult{rec, err})
+			}
+			block = nil
+			start = n + 1
+			return ok
+		}
+		for scanner.Scan() {
+			n++
+			line := scanner.Text()
+			if line == "---" {
+				if !flush() {
+					return
+				}
+				continue
+			}
+			block = append(block, line)
+		}
+		if err := scanner.Err(); err != nil {
+			send(kafkaRecordResult{err: fmt.Errorf("line %d: %v", n+1, err)})
+			return
+		}
+		flush()
+	}()
+	return results
+}
+
+// parseKafkaRecord parses the lines of one record starting on line start.
+func parseKafkaRecord(start int, lines []string) (*kafkaRecord, error) {
+	rec := &kafkaRecord{line: start, headers: map[string]string{}}
+	for i, line := range lines {
+		if line == "" {
+			rec.value = strings.Join(lines[i+1:], "\n")
+			return rec, nil
+		}
+		switch {
+		case strings.HasPrefix(line, "key:"):
+			rec.key = strings.TrimSpace(strings.TrimPrefix(line, "key:"))
+		case strings.HasPrefix(line, "header:"):
+			h := strings.TrimSpace(strings.TrimPrefix(line, "header:"))
+			j := strings.Index(h, "=")
+			if j < 1 {
+				return nil, fmt.Errorf("line %d: header %q is not name=value", start+i, h)
+			}
+			rec.headers[h[:j]] = h[j+1:]
+		default:
+			return nil, fmt.Errorf("line %d: expected key:, header: or a blank line, got %q", start+i, line)
+		}
+	}
+	return nil, fmt.Errorf("line %d: record has no blank line before its value", start)
+}
+
+// readKafkaFile passes add one record per record of the Kafka dump at path
+// until add returns false, mapping headers to attributes and the key to the
+// kafka-key attribute. Records which fail to parse are logged and skipped.
+func readKafkaFile(path string, add func(fileRecord) bool) (failed int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Closing done on return stops the reader if add stops early.
+	done := make(chan struct{})
+	defer close(done)
+	for res := range readKafkaDump(f, done) {
+		if res.err != nil {
+			log.Errorf("error parsing record: %v", res.err)
+			failed++
+			continue
+		}
+		attrs := res.rec.headers
+		if res.rec.key != "" {
+			attrs[kafkaKeyAttr] = res.rec.key
+		}
+		rec := fileRecord{
+			data:  []byte(res.rec.value),
+			attrs: attrs,
+			where: fmt.Sprintf("record at line %d", res.rec.line),
+		}
+		if !add(rec) {
+			return failed, nil
+		}
+	}
+	return failed, nil
+}
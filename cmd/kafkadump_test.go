@@ -0,0 +1,129 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKafkaRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    *kafkaRecord
+		wantErr bool
+	}{
+		{"full", []string{"key: user-42", "header: source=orders", "header: trace-id=a=b", "", `{"order": 1}`},
+			&kafkaRecord{line: 3, key: "user-42", headers: map[string]string{"source": "orders", "trace-id": "a=b"}, value: `{"order": 1}`}, false},
+		{"no key", []string{"header: h=v", "", "value"},
+			&kafkaRecord{line: 3, headers: map[string]string{"h": "v"}, value: "value"}, false},
+		{"value only", []string{"", "line one", "", "line three"},
+			&kafkaRecord{line: 3, headers: map[string]string{}, value: "line one\n\nline three"}, false},
+		{"empty value", []string{"key: k", ""},
+			&kafkaRecord{line: 3, key: "k", headers: map[string]string{}}, false},
+		{"header without =", []string{"header: novalue", "", "v"}, nil, true},
+		{"header without name", []string{"header: =v", "", "v"}, nil, true},
+		{"unknown line", []string{"partition: 3", "", "v"}, nil, true},
+		{"no blank line", []string{"key: k", "header: h=v"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseKafkaRecord(3, tt.lines)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseKafkaRecord = %+v, %v, want %+v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestReadKafkaDump(t *testing.T) {
+	dump := "key: a\n\none\n---\nbogus\n\ntwo\n---\n---\nheader: h=v\n\nthree\nlines\n"
+	var values []string
+	var failed []int
+	for res := range readKafkaDump(strings.NewReader(dump), make(chan struct{})) {
+		if res.err != nil {
+			failed = append(failed, len(values))
+			continue
+		}
+		values = append(values, res.rec.value)
+	}
+	if want := []string{"one", "three\nlines"}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values = %q, want %q", values, want)
+	}
+	if want := []int{1}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed after %v records, want %v", failed, want)
+	}
+}
+
+func TestReadKafkaDumpStop(t *testing.T) {
+	const records = 1000
+	dump := strings.Repeat("\nvalue\n---\n", records)
+	done := make(chan struct{})
+	results := readKafkaDump(strings.NewReader(dump), done)
+	<-results
+	close(done)
+
+	got := 1
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-results:
+			if !ok {
+				if got >= records {
+					t.Errorf("read all %d records after stopping", got)
+				}
+				return
+			}
+			got++
+		case <-timeout:
+			t.Fatal("reader didn't stop")
+		}
+	}
+}
+
+func TestReadKafkaFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubbing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump")
+	dump := "key: k1\nheader: h=v\n\none\n---\nbad\n\nx\n---\n\ntwo\n---\n\nthree\n"
+	if err := ioutil.WriteFile(path, []byte(dump), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var recs []fileRecord
+	failed, err := readKafkaFile(path, func(r fileRecord) bool {
+		recs = append(recs, r)
+		return len(recs) < 2
+	})
+	if err != nil || failed != 1 {
+		t.Errorf("readKafkaFile = %d, %v, want 1 failed", failed, err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("read %d records, want 2 before add stopped", len(recs))
+	}
+	if want := map[string]string{"h": "v", kafkaKeyAttr: "k1"}; !reflect.DeepEqual(recs[0].attrs, want) {
+		t.Errorf("record 0 attributes = %v, want %v", recs[0].attrs, want)
+	}
+	if string(recs[0].data) != "one" || string(recs[1].data) != "two" || recs[1].where != "record at line 10" {
+		t.Errorf("records = %+v", recs)
+	}
+}
@@ -20,7 +20,6 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"golang.org/x/net/context"
 	"google.golang.org/api/pubsub/v1"
 )
 
@@ -42,7 +41,7 @@ var listCmd = &cobra.Command{
 
 		// The name of the cloud project that topics belong to.
 		project := fmt.Sprintf("projects/%s", Gceproject)
-		ctx := context.Background()
+		ctx := rootCtx
 
 		call := c.Projects.Topics.List(project)
 		if err := call.Pages(ctx, func(page *pubsub.ListTopicsResponse) error {
@@ -0,0 +1,58 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// fieldsHook adds its fields to every log entry which doesn't already set
+// them, so lines logged from any goroutine or helper are attributable.
+type fieldsHook struct {
+	fields log.Fields
+}
+
+func (h *fieldsHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel}
+}
+
+func (h *fieldsHook) Fire(e *log.Entry) error {
+	for k, v := range h.fields {
+		if _, ok := e.Data[k]; !ok {
+			e.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// commandFields returns the fields identifying cmd and the project, topic
+// and subscription it runs against, omitting any which are unset.
+func commandFields(cmd *cobra.Command) log.Fields {
+	fields := log.Fields{"cmd": strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" ")}
+	for k, v := range map[string]string{"project": Gceproject, "topic": Topic, "sub": subscription} {
+		if v != "" {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// logFieldsSetup tags every log line of the run with cmd's fields.
+func logFieldsSetup(cmd *cobra.Command) {
+	log.AddHook(&fieldsHook{fields: commandFields(cmd)})
+}
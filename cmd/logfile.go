@@ -0,0 +1,92 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// reopenFile is an append-only file which can be reopened at the same path,
+// eg: after logrotate has moved it aside.
+type reopenFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openReopenFile(path string) (*reopenFile, error) {
+	rf := &reopenFile{path: path}
+	if err := rf.Reopen(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *reopenFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Write(p)
+}
+
+// Reopen closes the current file, if any, and opens path for appending.
+func (rf *reopenFile) Reopen() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f != nil {
+		rf.f.Close()
+	}
+	rf.f = f
+	return nil
+}
+
+// logFileSetup directs logs to LogFile, also copying them to stderr when
+// LogAlsoStderr is set, and reopens the file on SIGHUP.
+func logFileSetup() {
+	if LogFile == "" {
+		return
+	}
+	rf, err := openReopenFile(LogFile)
+	if err != nil {
+		log.Errorf("error opening log file: %v", err)
+		os.Exit(1)
+	}
+	var out io.Writer = rf
+	if LogAlsoStderr {
+		out = io.MultiWriter(rf, os.Stderr)
+	}
+	log.SetOutput(out)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := rf.Reopen(); err != nil {
+				log.Errorf("error reopening log file: %v", err)
+				continue
+			}
+			log.Infof("Reopened log file %s", LogFile)
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+var tailTopics []string
+
+// tailRetryDelay is how long a topic's tail waits before pulling again after
+// an error.
+const tailRetryDelay = time.Second
+
+// tailLine is a message consumed by multitail and the topic it came from.
+type tailLine struct {
+	topic string
+	data  []byte
+}
+
+// tailTopic subscribes a temporary subscription to the named topic and sends
+// each message it receives to lines until ctx is cancelled. Pull errors are
+// logged and retried so one topic's failure doesn't end the others' tails.
+// The subscription is always deleted before returning.
+func tailTopic(ctx context.Context, client *pubsub.Client, name string, lines chan<- tailLine) error {
+	subName := "pubbing-tail-" + uuid.New()
+	sub, err := client.NewSubscription(ctx, subName, client.Topic(name), 0, nil)
+	if err != nil {
+		return fmt.Errorf("error creating temporary subscription: %v", err)
+	}
+	log.Debugf("Created temporary subscription %s on %s", subName, name)
+	defer func() {
+		// Use a fresh context so cleanup still happens after a signal.
+		if err := sub.Delete(context.Background()); err != nil {
+			log.Errorf("error deleting temporary subscription %s: %v", subName, err)
+			return
+		}
+		log.Debugf("Deleted temporary subscription %s", subName)
+	}()
+
+	for ctx.Err() == nil {
+		if err := drainTail(ctx, sub, name, lines); err != nil {
+			log.Warnf("error tailing %s, retrying in %v: %v", name, tailRetryDelay, err)
+			select {
+			case <-time.After(tailRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}
+	return nil
+}
+
+// drainTail pulls from sub, acking each message and sending it to lines,
+// until ctx is cancelled or the pull fails.
+func drainTail(ctx context.Context, sub *pubsub.Subscription, name string, lines chan<- tailLine) error {
+	it, err := sub.Pull(ctx)
+	if err != nil {
+		return err
+	}
+	defer it.Stop()
+	for {
+		m, err := it.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		m.Done(true)
+		select {
+		case lines <- tailLine{topic: name, data: m.Data}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// multitailCmd represents the multitail command
+var multitailCmd = &cobra.Command{
+	Use:   "multitail",
+	Short: "Interleave the messages of several topics on stdout",
+	Long: `Create a temporary subscription on each --topic and print the messages
+they receive, prefixed with their topic, until interrupted. The temporary
+subscriptions are deleted on exit. A topic which can't be tailed is logged
+and the others carry on.
+
+eg: pubbing multitail --topic=orders --topic=payments`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(tailTopics) == 0 {
+			log.Errorf("at least one --topic must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+
+		lines := make(chan tailLine)
+		var failed int
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, t := range tailTopics {
+			wg.Add(1)
+			go func(t string) {
+				defer wg.Done()
+				if err := tailTopic(ctx, psClient, t, lines); err != nil {
+					log.Errorf("error tailing topic %s: %v", t, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}(t)
+		}
+		go func() {
+			wg.Wait()
+			close(lines)
+		}()
+
+		log.Infof("Tailing %d topics", len(tailTopics))
+		for l := range lines {
+			fmt.Printf("[%s] %s\n", l.topic, l.data)
+		}
+		if failed == len(tailTopics) {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(multitailCmd)
+
+	// Shadows the root --topic so it may be repeated.
+	multitailCmd.Flags().StringSliceVar(&tailTopics, "topic", nil, "topic to tail; repeatable")
+}
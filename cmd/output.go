@@ -0,0 +1,252 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/cloud/pubsub"
+)
+
+// messageWriter writes consumed messages in one of the sub --output formats.
+type messageWriter interface {
+	Write(m *pubsub.Message) error
+	// Flush writes any buffered output.
+	Flush() error
+}
+
+// outputStream is the destination for consumed messages, optionally
+// buffered. Close must be called on shutdown to flush and close what was
+// opened, or a compressed file will be truncated.
+type outputStream struct {
+	io.Writer
+	buf     *bufio.Writer
+	closers []io.Closer
+}
+
+// Flush writes any buffered output through to the destination.
+func (o *outputStream) Flush() error {
+	if o.buf == nil {
+		return nil
+	}
+	return o.buf.Flush()
+}
+
+// Close flushes the buffer then closes the outermost writer first, so the
+// gzip footer reaches the file.
+func (o *outputStream) Close() error {
+	first := o.Flush()
+	for i := len(o.closers) - 1; i >= 0; i-- {
+		if err := o.closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// openOutput opens the destination for consumed messages: stdout, the Unix
+// socket at socket, or the file at path, gzip compressed when gz is set.
+// With buffered, writes are buffered until Flush; sockets are never
+// buffered so write errors are seen per message.
+func openOutput(path, socket string, gz, buffered bool) (*outputStream, error) {
+	o := &outputStream{Writer: os.Stdout}
+	if socket != "" {
+		sw := newSocketWriter(socket, outSocketRetry)
+		o.Writer = sw
+		o.closers = append(o.closers, sw)
+		buffered = false
+	} else if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		o.Writer = f
+		o.closers = append(o.closers, f)
+	}
+	if gz {
+		zw := gzip.NewWriter(o.Writer)
+		o.Writer = zw
+		o.closers = append(o.closers, zw)
+	}
+	if buffered {
+		o.buf = bufio.NewWriter(o.Writer)
+		o.Writer = o.buf
+	}
+	return o, nil
+}
+
+// newMessageWriter returns a messageWriter for format which writes to w,
+// redacting the attributes named by --redact-attr.
+func newMessageWriter(format string, w io.Writer) (messageWriter, error) {
+	if decodeMode != "" && decodeMode != "auto" {
+		return nil, fmt.Errorf("unknown decode mode: %s", decodeMode)
+	}
+	decode := decodeMode == "auto"
+
+	var mw messageWriter
+	switch format {
+	case "csv":
+		cw, err := newCSVWriter(w, csvAttrs, !attributesOnly)
+		if err != nil {
+			return nil, err
+		}
+		cw.text = decode
+		mw = cw
+	case "json":
+		enc := json.NewEncoder(w)
+		if decode {
+			enc.SetIndent("", "  ")
+		}
+		mw = &jsonWriter{enc: enc, withData: !attributesOnly, text: decode}
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
+	if decode {
+		mw = newDecodingWriter(mw)
+	}
+	if len(redactAttrs) > 0 {
+		mw = &redactingWriter{messageWriter: mw, keys: redactAttrs}
+	}
+	return mw, nil
+}
+
+// redacted replaces the values of redacted attributes.
+const redacted = "***"
+
+// redactingWriter writes messages with the values of the attributes in keys
+// replaced, leaving the consumed message itself untouched.
+type redactingWriter struct {
+	messageWriter
+	keys []string
+}
+
+func (rw *redactingWriter) Write(m *pubsub.Message) error {
+	return rw.messageWriter.Write(redactMessage(m, rw.keys))
+}
+
+// redactMessage returns a copy of m with the value of each attribute in keys
+// replaced, or m itself if it has none of them.
+func redactMessage(m *pubsub.Message, keys []string) *pubsub.Message {
+	var attrs map[string]string
+	for _, k := range keys {
+		if _, ok := m.Attributes[k]; !ok {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string, len(m.Attributes))
+			for ak, av := range m.Attributes {
+				attrs[ak] = av
+			}
+		}
+		attrs[k] = redacted
+	}
+	if attrs == nil {
+		return m
+	}
+	return &pubsub.Message{ID: m.ID, Data: m.Data, Attributes: attrs, AckID: m.AckID}
+}
+
+// jsonMessage is a consumed message as written by --output=json.
+type jsonMessage struct {
+	ID         string            `json:"id"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// textJSONMessage is a consumed message as written by --output=json with
+// --decode, its data inlined as JSON or a string rather than base64.
+type textJSONMessage struct {
+	ID         string            `json:"id"`
+	Data       interface{}       `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// jsonWriter writes one JSON object per line for each message. Without data
+// only the message's attributes map is written. With text, data is written
+// as text, or inline when the message's content type is JSON.
+type jsonWriter struct {
+	enc      *json.Encoder
+	withData bool
+	text     bool
+}
+
+func (jw *jsonWriter) Write(m *pubsub.Message) error {
+	if !jw.withData {
+		attrs := m.Attributes
+		if attrs == nil {
+			attrs = map[string]string{}
+		}
+		return jw.enc.Encode(attrs)
+	}
+	if jw.text {
+		var data interface{} = string(m.Data)
+		if isJSONMessage(m) && json.Valid(m.Data) {
+			data = json.RawMessage(m.Data)
+		}
+		return jw.enc.Encode(&textJSONMessage{ID: m.ID, Data: data, Attributes: m.Attributes})
+	}
+	return jw.enc.Encode(&jsonMessage{ID: m.ID, Data: m.Data, Attributes: m.Attributes})
+}
+
+func (jw *jsonWriter) Flush() error { return nil }
+
+// csvWriter writes a header row followed by one row per message with the
+// message ID, base64 encoded data, or the data as text with text set, and
+// the value of each selected attribute.
+type csvWriter struct {
+	w        *csv.Writer
+	attrs    []string
+	withData bool
+	text     bool
+}
+
+func newCSVWriter(w io.Writer, attrs []string, withData bool) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), attrs: attrs, withData: withData}
+	header := []string{"id"}
+	if withData {
+		header = append(header, "data")
+	}
+	header = append(header, attrs...)
+	if err := cw.w.Write(header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(m *pubsub.Message) error {
+	row := make([]string, 0, 2+len(cw.attrs))
+	row = append(row, m.ID)
+	if cw.withData && cw.text {
+		row = append(row, string(m.Data))
+	} else if cw.withData {
+		row = append(row, base64.StdEncoding.EncodeToString(m.Data))
+	}
+	for _, k := range cw.attrs {
+		row = append(row, m.Attributes[k])
+	}
+	return cw.w.Write(row)
+}
+
+func (cw *csvWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
@@ -0,0 +1,117 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/cloud/pubsub"
+)
+
+func TestRedactedOutput(t *testing.T) {
+	defer func(redact, cols []string, attrsOnly bool, decode string) {
+		redactAttrs, csvAttrs, attributesOnly, decodeMode = redact, cols, attrsOnly, decode
+	}(redactAttrs, csvAttrs, attributesOnly, decodeMode)
+	redactAttrs = []string{"email", "token"}
+	csvAttrs = []string{"email", "token", "region"}
+
+	const secret = "alice@example.com"
+	tests := []struct {
+		format    string
+		attrsOnly bool
+		decode    string
+	}{
+		{"csv", false, ""},
+		{"csv", true, ""},
+		{"csv", false, "auto"},
+		{"json", false, ""},
+		{"json", true, ""},
+		{"json", false, "auto"},
+		{"json", true, "auto"},
+	}
+	for _, tt := range tests {
+		attributesOnly, decodeMode = tt.attrsOnly, tt.decode
+		var buf bytes.Buffer
+		w, err := newMessageWriter(tt.format, &buf)
+		if err != nil {
+			t.Fatalf("%+v: newMessageWriter: %v", tt, err)
+		}
+		m := &pubsub.Message{
+			ID:         "1",
+			Data:       []byte(`{"user": "someone"}`),
+			Attributes: map[string]string{"email": secret, "token": secret, "region": "eu", "content-type": "application/json"},
+		}
+		if err := w.Write(m); err != nil {
+			t.Fatalf("%+v: Write: %v", tt, err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("%+v: Flush: %v", tt, err)
+		}
+
+		out := buf.String()
+		if strings.Contains(out, secret) {
+			t.Errorf("%+v: output has a redacted value: %s", tt, out)
+		}
+		if !strings.Contains(out, redacted) || !strings.Contains(out, "eu") {
+			t.Errorf("%+v: output doesn't have the redacted and kept attributes: %s", tt, out)
+		}
+		if m.Attributes["email"] != secret {
+			t.Errorf("%+v: consumed message was redacted", tt)
+		}
+	}
+}
+
+// BenchmarkFlushInterval writes messages to a file, flushing after every
+// message as unbuffered output does, or once per batch as --flush-interval
+// does between ticks.
+func BenchmarkFlushInterval(b *testing.B) {
+	dir, err := ioutil.TempDir("", "pubbing")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &pubsub.Message{ID: "1", Data: bytes.Repeat([]byte("x"), 200), Attributes: map[string]string{"region": "eu"}}
+	for _, every := range []int{1, 1000} {
+		b.Run(fmt.Sprintf("every%d", every), func(b *testing.B) {
+			o, err := openOutput(filepath.Join(dir, "out"), "", false, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer o.Close()
+			w, err := newMessageWriter("json", o)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.Write(m); err != nil {
+					b.Fatal(err)
+				}
+				if (i+1)%every == 0 {
+					if err := o.Flush(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
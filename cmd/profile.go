@@ -0,0 +1,148 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+// profileTick is how often a steady phase tops up to its target rate.
+const profileTick = 100 * time.Millisecond
+
+// loadPhase is one phase of a --profile: a burst of count messages, or a
+// steady rate in msgs/s for dur, or until interrupted if dur is 0.
+type loadPhase struct {
+	spec  string
+	burst bool
+	count int
+	rate  float64
+	dur   time.Duration
+}
+
+// parseProfile parses a --profile of comma separated phases, each either
+// burst:N or steady:RATE[@DURATION], eg: burst:1000,steady:100@1m. Only
+// the last phase may be a steady phase without a duration.
+func parseProfile(s string) ([]loadPhase, error) {
+	var phases []loadPhase
+	specs := strings.Split(s, ",")
+	for i, spec := range specs {
+		p := loadPhase{spec: spec}
+		j := strings.Index(spec, ":")
+		if j < 0 {
+			return nil, fmt.Errorf("invalid phase %q: want burst:N or steady:RATE[@DURATION]", spec)
+		}
+		kind, arg := spec[:j], spec[j+1:]
+		switch kind {
+		case "burst":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid phase %q: burst needs a positive count", spec)
+			}
+			p.burst, p.count = true, n
+		case "steady":
+			if k := strings.Index(arg, "@"); k >= 0 {
+				d, err := time.ParseDuration(arg[k+1:])
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("invalid phase %q: bad duration", spec)
+				}
+				p.dur, arg = d, arg[:k]
+			} else if i < len(specs)-1 {
+				return nil, fmt.Errorf("invalid phase %q: only the last steady phase may omit @DURATION", spec)
+			}
+			r, err := strconv.ParseFloat(arg, 64)
+			if err != nil || r <= 0 {
+				return nil, fmt.Errorf("invalid phase %q: steady needs a positive rate", spec)
+			}
+			p.rate = r
+		default:
+			return nil, fmt.Errorf("invalid phase %q: unknown kind %q", spec, kind)
+		}
+		phases = append(phases, p)
+	}
+	return phases, nil
+}
+
+// publishN publishes n generated messages to topic in batches of pubBatch,
+// numbering them from *seq, and returns the number published. It stops
+// early if rootCtx is cancelled.
+func publishN(ctx context.Context, topic *pubsub.Topic, n int, seq *int) int {
+	published := 0
+	msgs := make([]*pubsub.Message, 0, pubBatch)
+	for i := 0; i < n && rootCtx.Err() == nil; i++ {
+		*seq++
+		msg, err := newMessage([]byte(fmt.Sprintf("profile %d %v", *seq, time.Now())))
+		if err != nil {
+			log.Errorf("error creating message: %v", err)
+			continue
+		}
+		msgs = append(msgs, msg)
+		if len(msgs) >= pubBatch {
+			published += publishBatch(ctx, topic, msgs)
+			msgs = msgs[:0]
+		}
+	}
+	return published + publishBatch(ctx, topic, msgs)
+}
+
+// runProfile publishes generated messages to topic following phases until
+// they complete or rootCtx is cancelled, logging each phase's throughput.
+// It returns the total number published.
+func runProfile(ctx context.Context, topic *pubsub.Topic, phases []loadPhase) int {
+	total, seq := 0, 0
+	for _, p := range phases {
+		if rootCtx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		published := 0
+		if p.burst {
+			published = publishN(ctx, topic, p.count, &seq)
+		} else {
+			ticker := time.NewTicker(profileTick)
+			var end <-chan time.Time
+			if p.dur > 0 {
+				end = time.After(p.dur)
+			}
+			sent := 0
+		steady:
+			for {
+				select {
+				case <-ticker.C:
+					due := int(p.rate*time.Since(start).Seconds()) - sent
+					if due > 0 {
+						sent += due
+						published += publishN(ctx, topic, due, &seq)
+					}
+				case <-end:
+					break steady
+				case <-rootCtx.Done():
+					break steady
+				}
+			}
+			ticker.Stop()
+		}
+		elapsed := time.Since(start)
+		log.Infof("Phase %s: published %d in %v: %f msgs/s", p.spec, published, elapsed, float64(published)/elapsed.Seconds())
+		total += published
+	}
+	return total
+}
@@ -0,0 +1,85 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	progressWidth    = 40
+	progressInterval = 200 * time.Millisecond
+)
+
+// progressBar redraws a single line showing how far through a bounded run
+// of total items we are, with an ETA from the average rate so far.
+type progressBar struct {
+	w     io.Writer
+	total int
+	start time.Time
+	last  time.Time
+	drawn bool
+}
+
+// newProgressBar returns a bar for a run of total items, or nil when stdout
+// isn't a terminal so piped output stays clean. A nil bar ignores updates.
+func newProgressBar(total int) *progressBar {
+	if total <= 0 || !log.IsTerminal() {
+		return nil
+	}
+	return &progressBar{w: os.Stdout, total: total, start: time.Now()}
+}
+
+// Update redraws the bar for n completed items, at most every
+// progressInterval.
+func (p *progressBar) Update(n int) {
+	if p == nil {
+		return
+	}
+	now := time.Now()
+	if n < p.total && now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	if n > p.total {
+		n = p.total
+	}
+
+	eta := "?"
+	if elapsed := now.Sub(p.start).Seconds(); n > 0 && elapsed > 0 {
+		rate := float64(n) / elapsed
+		left := time.Duration(float64(p.total-n)/rate) * time.Second
+		eta = left.String()
+	}
+	filled := progressWidth * n / p.total
+	fmt.Fprintf(p.w, "\r[%s%s] %d/%d %3d%% eta %s\033[K",
+		strings.Repeat("=", filled), strings.Repeat(" ", progressWidth-filled),
+		n, p.total, 100*n/p.total, eta)
+	p.drawn = true
+}
+
+// Done ends the bar's line so following output starts cleanly.
+func (p *progressBar) Done() {
+	if p == nil || !p.drawn {
+		return
+	}
+	fmt.Fprintln(p.w)
+}
@@ -15,18 +15,419 @@
 package cmd
 
 import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"golang.org/x/net/context"
-
 	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
 	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/pubsub"
 )
 
+// expiresAtAttr holds the RFC3339 time after which a message published with
+// --ttl is stale.
+const expiresAtAttr = "expires-at"
+
+var (
+	contentType string
+	fromStdin   bool
+	stdinLines  bool
+	delimiter   string
+	follow      bool
+	pubBatch    int
+	pubURL      string
+	pubTimeout  time.Duration
+	csvFile     string
+	csvAttrCols []string
+	kafkaDump   string
+	profile     string
+	pubSigner   *signer
+	chunk       bool
+	chunkSize   int
+
+	sequenceAttr string
+	// sequence is the last sequence number stamped by --sequence-attr.
+	sequence int64
+
+	dedupKeyFrom string
+	dedupAttr    string
+
+	ttl time.Duration
+
+	partitionKeyFrom string
+	partitionAttr    string
+	partitions       int
+
+	attrFromJSON []string
+	// jsonAttrs are the parsed --attr-from-json rules.
+	jsonAttrs []jsonAttr
+
+	routes       []string
+	defaultTopic string
+	// pubRouter routes batches by attribute when --route is given.
+	pubRouter *router
+
+	errorsFile string
+	// pubErrors records messages which failed to publish to --errors-file.
+	pubErrors *publishErrors
+)
+
+// dedupKey returns the dedup attribute value for data using strategy:
+// sha256 or md5 of the payload, so identical payloads share a key, or a
+// random uuid.
+func dedupKey(strategy string, data []byte) (string, error) {
+	switch strategy {
+	case "sha256":
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	case "md5":
+		sum := md5.Sum(data)
+		return hex.EncodeToString(sum[:]), nil
+	case "uuid":
+		return uuid.New(), nil
+	}
+	return "", fmt.Errorf("unknown dedup key strategy %q: want sha256, md5 or uuid", strategy)
+}
+
+// partition returns the partition of key out of n: the 32-bit FNV-1a hash
+// of key modulo n. Consumers can reproduce it with any FNV-1a
+// implementation.
+func partition(key []byte, n int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// validPartitionKeyFrom reports whether from is payload or attr:<name>.
+func validPartitionKeyFrom(from string) bool {
+	return from == "payload" || (strings.HasPrefix(from, "attr:") && len(from) > len("attr:"))
+}
+
+// partitionKey returns the key --partition-key-from selects for a message
+// with data and attrs: the payload, or the value of attribute attr:<name>.
+func partitionKey(from string, data []byte, attrs map[string]string) ([]byte, error) {
+	if from == "payload" {
+		return data, nil
+	}
+	name := strings.TrimPrefix(from, "attr:")
+	v, ok := attrs[name]
+	if !ok {
+		return nil, fmt.Errorf("partition key attribute %q not set", name)
+	}
+	return []byte(v), nil
+}
+
+// newMessage returns a message holding data with the attributes configured
+// by pub's flags. It fails only if an --attr-from-json rule can't be applied
+// to data, or the --partition-key-from attribute isn't set.
+func newMessage(data []byte) (*pubsub.Message, error) {
+	return newRecordMessage(data, nil)
+}
+
+// newRecordMessage is newMessage for a record carrying its own attributes,
+// such as a CSV row's columns. They're set before the flags' attributes are
+// stamped, so --partition-key-from can use them, and can't replace the
+// stamped ones. The signature and chunk attributes are never taken from a
+// record.
+func newRecordMessage(data []byte, recAttrs map[string]string) (*pubsub.Message, error) {
+	attrs := map[string]string{}
+	if len(jsonAttrs) > 0 {
+		var err error
+		if attrs, err = jsonAttributes(jsonAttrs, data); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range recAttrs {
+		switch k {
+		case signatureAttr, chunkIDAttr, chunkIndexAttr, chunkTotalAttr:
+			log.Debugf("ignoring reserved record attribute %s", k)
+		default:
+			attrs[k] = v
+		}
+	}
+	if contentType != "" {
+		attrs["content-type"] = contentType
+	}
+	if sequenceAttr != "" {
+		sequence++
+		attrs[sequenceAttr] = strconv.FormatInt(sequence, 10)
+	}
+	if ttl > 0 {
+		attrs[expiresAtAttr] = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	}
+	if dedupKeyFrom != "" {
+		// The strategy is validated before publishing starts.
+		key, _ := dedupKey(dedupKeyFrom, data)
+		attrs[dedupAttr] = key
+	}
+
+	if partitionKeyFrom != "" {
+		key, err := partitionKey(partitionKeyFrom, data, attrs)
+		if err != nil {
+			return nil, err
+		}
+		attrs[partitionAttr] = strconv.Itoa(partition(key, partitions))
+	}
+	if pubSigner != nil {
+		attrs[signatureAttr] = pubSigner.Sign(data)
+	}
+
+	msg := &pubsub.Message{Data: data}
+	if len(attrs) > 0 {
+		msg.Attributes = attrs
+	}
+	return msg, nil
+}
+
+// chunkMessage splits msg into chunks of at most size bytes with
+// splitChunks. Each chunk after the first takes the next sequence number,
+// and the dedup key gains the chunk index, so consumers deduplicating by
+// either don't take the chunks for replays of the first.
+func chunkMessage(msg *pubsub.Message, size int) []*pubsub.Message {
+	chunks := splitChunks(msg, size)
+	if len(chunks) == 1 {
+		return chunks
+	}
+	for i, c := range chunks {
+		if sequenceAttr != "" && i > 0 {
+			sequence++
+			c.Attributes[sequenceAttr] = strconv.FormatInt(sequence, 10)
+		}
+		if key, ok := c.Attributes[dedupAttr]; ok && dedupKeyFrom != "" {
+			c.Attributes[dedupAttr] = key + "-" + strconv.Itoa(i)
+		}
+	}
+	return chunks
+}
+
+// publishChunks publishes chunks one per request to stay under the request
+// size limit, returning the number published.
+func publishChunks(ctx context.Context, topic *pubsub.Topic, chunks []*pubsub.Message) int {
+	published := 0
+	for _, c := range chunks {
+		published += publishBatch(ctx, topic, []*pubsub.Message{c})
+	}
+	return published
+}
+
+// setAttribute sets the attribute k of m to v.
+func setAttribute(m *pubsub.Message, k, v string) {
+	if m.Attributes == nil {
+		m.Attributes = map[string]string{}
+	}
+	m.Attributes[k] = v
+}
+
+// publishBatch publishes msgs to topic, logging any error, and returns the
+// number of messages published. With --route, msgs are published to their
+// routed topics instead.
+func publishBatch(ctx context.Context, topic *pubsub.Topic, msgs []*pubsub.Message) int {
+	if len(msgs) == 0 {
+		return 0
+	}
+	if pubRouter != nil {
+		return pubRouter.Publish(ctx, msgs)
+	}
+	return publishTo(ctx, topic, msgs)
+}
+
+// fetchURL returns the body of a GET of url, failing on non-2xx responses.
+func fetchURL(url string, timeout time.Duration) ([]byte, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// readCSV passes add one record per row of the CSV file at path until add
+// returns false. Each payload is the row as a JSON object keyed by the
+// header, and the columns in csvAttrCols are also set as attributes. Rows
+// which fail to parse are logged by line and skipped.
+func readCSV(path string, add func(fileRecord) bool) (failed int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return 0, fmt.Errorf("error reading header: %v", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if name == "" {
+			return 0, fmt.Errorf("header column %d is empty", i+1)
+		}
+		if _, ok := columns[name]; ok {
+			return 0, fmt.Errorf("header column %q is duplicated", name)
+		}
+		columns[name] = i
+	}
+	for _, name := range csvAttrCols {
+		if _, ok := columns[name]; !ok {
+			return 0, fmt.Errorf("attribute column %q is not in the header", name)
+		}
+	}
+
+	rows := 0
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				log.Errorf("error parsing line %d: %v", perr.Line, perr.Err)
+				failed++
+				continue
+			}
+			return failed, err
+		}
+		rows++
+
+		obj := make(map[string]string, len(header))
+		for i, name := range header {
+			obj[name] = row[i]
+		}
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return failed, err
+		}
+		rec := fileRecord{data: data, where: fmt.Sprintf("row %d", rows)}
+		if len(csvAttrCols) > 0 {
+			rec.attrs = make(map[string]string, len(csvAttrCols))
+			for _, name := range csvAttrCols {
+				rec.attrs[name] = row[columns[name]]
+			}
+		}
+		if !add(rec) {
+			return failed, nil
+		}
+	}
+	return failed, nil
+}
+
+// parseDelimiter interprets the Go escapes in s, such as \n or \x00, so
+// delimiters which can't be typed as arguments can be given.
+func parseDelimiter(s string) (string, error) {
+	d, err := strconv.Unquote(`"` + strings.Replace(s, `"`, `\"`, -1) + `"`)
+	if err != nil {
+		return "", fmt.Errorf("invalid delimiter %q: %v", s, err)
+	}
+	if d == "" {
+		return "", fmt.Errorf("delimiter must not be empty")
+	}
+	return d, nil
+}
+
+// readLines sends each non-empty segment of r separated by delim on the
+// returned channel, without its delimiter, and closes the channel at EOF.
+// A final segment without a trailing delimiter is still sent.
+func readLines(r io.Reader, delim string) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		br := bufio.NewReader(r)
+		last := delim[len(delim)-1]
+		var segment string
+		for {
+			// Read up to the delimiter's last byte, then check the rest of
+			// it precedes, so multi-byte delimiters split correctly.
+			chunk, err := br.ReadString(last)
+			segment += chunk
+			if err == nil && !strings.HasSuffix(segment, delim) {
+				continue
+			}
+			if line := strings.TrimSuffix(segment, delim); line != "" {
+				lines <- line
+			}
+			segment = ""
+			if err != nil {
+				if err != io.EOF {
+					log.Errorf("error reading input: %v", err)
+				}
+				return
+			}
+		}
+	}()
+	return lines
+}
+
+// publishLines publishes each line of r as a message in batches of pubBatch
+// until EOF or rootCtx is cancelled, returning the number published. In
+// follow mode partial batches are also flushed every second so a slow
+// stream such as tail -f is published as it arrives.
+func publishLines(ctx context.Context, topic *pubsub.Topic, r io.Reader) int {
+	var tick <-chan time.Time
+	if follow {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	published := 0
+	lines := readLines(r, delimiter)
+	msgs := make([]*pubsub.Message, 0, pubBatch)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return published + publishBatch(ctx, topic, msgs)
+			}
+			msg, err := newMessage([]byte(line))
+			if err != nil {
+				log.Errorf("skipping line: %v", err)
+				continue
+			}
+			if chunk {
+				if chunks := chunkMessage(msg, chunkSize); len(chunks) > 1 {
+					published += publishBatch(ctx, topic, msgs)
+					msgs = msgs[:0]
+					if n := publishChunks(ctx, topic, chunks); n < len(chunks) {
+						log.Errorf("published %d of %d chunks of a line", n, len(chunks))
+					} else {
+						published++
+					}
+					continue
+				}
+			}
+			msgs = append(msgs, msg)
+			if len(msgs) >= pubBatch {
+				published += publishBatch(ctx, topic, msgs)
+				msgs = msgs[:0]
+			}
+		case <-tick:
+			published += publishBatch(ctx, topic, msgs)
+			msgs = msgs[:0]
+		case <-rootCtx.Done():
+			return published + publishBatch(ctx, topic, msgs)
+		}
+	}
+}
+
 // pubCmd represents the pub command
 var pubCmd = &cobra.Command{
 	Use:   "pub",
@@ -44,7 +445,108 @@ to quickly create a Cobra application.`,
 			log.Errorf("GCE project and topic must be defined")
 			os.Exit(1)
 		}
-		ctx := context.Background()
+		if (stdinLines || follow) && !fromStdin {
+			log.Errorf("--lines and --follow require --stdin")
+			os.Exit(1)
+		}
+		if cmd.Flags().Changed("delimiter") && !stdinLines {
+			log.Errorf("--delimiter requires --stdin --lines")
+			os.Exit(1)
+		}
+		d, err := parseDelimiter(delimiter)
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		delimiter = d
+		if csvFile != "" && (fromStdin || pubURL != "") {
+			log.Errorf("--csv-file can't be used with --stdin or --url")
+			os.Exit(1)
+		}
+		if (pubRepeat || pubCount != 0) && csvFile == "" && kafkaDump == "" {
+			log.Errorf("--repeat and --count require --csv-file or --kafka-dump")
+			os.Exit(1)
+		}
+		if pubCount < 0 {
+			log.Errorf("--count must not be negative")
+			os.Exit(1)
+		}
+		if kafkaDump != "" && (csvFile != "" || fromStdin || pubURL != "") {
+			log.Errorf("--kafka-dump can't be used with --csv-file, --stdin or --url")
+			os.Exit(1)
+		}
+		if fromStdin && pubURL != "" {
+			log.Errorf("--stdin and --url can't be used together")
+			os.Exit(1)
+		}
+		if follow && !stdinLines {
+			log.Errorf("--follow requires --lines")
+			os.Exit(1)
+		}
+		if pubBatch < 1 || pubBatch > pubsub.MaxPublishBatchSize {
+			log.Errorf("batch must be between 1 and %d", pubsub.MaxPublishBatchSize)
+			os.Exit(1)
+		}
+		if dedupKeyFrom != "" {
+			if _, err := dedupKey(dedupKeyFrom, nil); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+		}
+		if signKey != "" {
+			var err error
+			if pubSigner, err = newSigner(signKey, hmacHash); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+		}
+		var phases []loadPhase
+		if profile != "" {
+			if csvFile != "" || kafkaDump != "" || fromStdin || pubURL != "" {
+				log.Errorf("--profile generates messages and can't be used with other inputs")
+				os.Exit(1)
+			}
+			var err error
+			if phases, err = parseProfile(profile); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+		}
+		for _, spec := range attrFromJSON {
+			a, err := parseJSONAttr(spec)
+			if err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+			jsonAttrs = append(jsonAttrs, a)
+		}
+		if chunk && chunkSize < 1 {
+			log.Errorf("--chunk-size must be at least 1")
+			os.Exit(1)
+		}
+		if partitionKeyFrom != "" {
+			if partitions < 1 {
+				log.Errorf("--partitions must be at least 1")
+				os.Exit(1)
+			}
+			if !validPartitionKeyFrom(partitionKeyFrom) {
+				log.Errorf("invalid --partition-key-from %q: want payload or attr:<name>", partitionKeyFrom)
+				os.Exit(1)
+			}
+		}
+		for _, spec := range routes {
+			if _, err := parseRoute(spec); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+		}
+		if err := setupStatsd(); err != nil {
+			log.Errorf("error setting up statsd: %v", err)
+			os.Exit(1)
+		}
+		defer stats.Close()
+
+		ctx := rootCtx
 		pubsubClient := initClient()
 		gctx := cloud.NewContext(Gceproject, pubsubClient)
 
@@ -59,19 +561,155 @@ to quickly create a Cobra application.`,
 			os.Exit(1)
 		}
 
+		if err := waitForTopicReady(ctx, psClient, Topic); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
 		topic := psClient.Topic(Topic)
+		if errorsFile != "" {
+			f, err := os.Create(errorsFile)
+			if err != nil {
+				log.Errorf("error creating errors file: %v", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			pubErrors = newPublishErrors(f)
+			defer func() {
+				if pubErrors.failed > 0 {
+					log.Warnf("%d messages failed to publish, see %s", pubErrors.failed, errorsFile)
+				}
+			}()
+		}
+		if len(routes) > 0 {
+			fallback := defaultTopic
+			if fallback == "" {
+				fallback = Topic
+			}
+			var err error
+			if pubRouter, err = newRouter(psClient, routes, fallback); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+			defer pubRouter.Report()
+		}
+		if csvFile != "" {
+			n, failed, err := publishFile(gctx, topic, csvFile, readCSV)
+			log.Infof("Published %d rows to %s, %d rows failed", n, Topic, failed)
+			if err != nil {
+				log.Errorf("error publishing %s: %v", csvFile, err)
+				os.Exit(1)
+			}
+			return
+		}
+		if len(phases) > 0 {
+			n := runProfile(gctx, topic, phases)
+			log.Infof("Published %d messages to %s", n, Topic)
+			return
+		}
+		if kafkaDump != "" {
+			n, failed, err := publishFile(gctx, topic, kafkaDump, readKafkaFile)
+			log.Infof("Published %d records to %s, %d records failed", n, Topic, failed)
+			if err != nil {
+				log.Errorf("error publishing %s: %v", kafkaDump, err)
+				os.Exit(1)
+			}
+			return
+		}
+		if fromStdin && stdinLines {
+			n := publishLines(gctx, topic, os.Stdin)
+			log.Infof("Published %d messages to %s", n, Topic)
+			return
+		}
+
 		bytes := []byte(fmt.Sprintf("helloworld %v", time.Now()))
-		ids, err := topic.Publish(gctx, &pubsub.Message{Data: bytes})
+		if fromStdin {
+			var err error
+			if bytes, err = ioutil.ReadAll(os.Stdin); err != nil {
+				log.Errorf("error reading stdin: %v", err)
+				os.Exit(1)
+			}
+		}
+		if pubURL != "" {
+			var err error
+			if bytes, err = fetchURL(pubURL, pubTimeout); err != nil {
+				log.Errorf("error fetching url: %v", err)
+				os.Exit(1)
+			}
+		}
+		msg, err := newMessage(bytes)
 		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		if pubURL != "" {
+			setAttribute(msg, "source-url", pubURL)
+		}
+		if chunk {
+			chunks := chunkMessage(msg, chunkSize)
+			published := publishChunks(gctx, topic, chunks)
+			log.Infof("Published %d of %d chunks", published, len(chunks))
+			if published < len(chunks) {
+				os.Exit(1)
+			}
+			return
+		}
+		if pubRouter != nil {
+			publishBatch(gctx, topic, []*pubsub.Message{msg})
+			return
+		}
+		start := time.Now()
+		ids, err := topic.Publish(gctx, msg)
+		stats.Timing("publish.latency", time.Since(start))
+		if err != nil {
+			stats.Incr("publish.errors", 1)
+			stats.Close()
 			log.Errorf("error publishing messages: %v", err)
+			if pubErrors != nil {
+				pubErrors.Record(topic, msg, err)
+			}
 			os.Exit(1)
 		}
+		stats.Incr("published", int64(len(ids)))
 		for _, id := range ids {
 			log.Infof("%#v", id)
+			if pubErrors != nil {
+				pubErrors.Published(topic, msg, id)
+			}
 		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(pubCmd)
+
+	pubCmd.Flags().BoolVar(&fromStdin, "stdin", false, "Publish data read from stdin instead of a debug message")
+	pubCmd.Flags().BoolVar(&stdinLines, "lines", false, "With --stdin, publish each line as a separate message")
+	pubCmd.Flags().StringVar(&delimiter, "delimiter", `\n`, "With --lines, split stdin on this string instead of newlines; Go escapes such as \\x00 are allowed")
+	pubCmd.Flags().BoolVar(&follow, "follow", false, "With --stdin --lines, publish lines as they arrive until EOF or signal")
+	pubCmd.Flags().StringVar(&pubURL, "url", "", "Publish the body fetched from this HTTP(S) URL")
+	pubCmd.Flags().DurationVar(&pubTimeout, "timeout", 30*time.Second, "Timeout for fetching --url")
+	pubCmd.Flags().StringVar(&csvFile, "csv-file", "", "Publish each row of this CSV file, with a header row, as a JSON message")
+	pubCmd.Flags().StringSliceVar(&csvAttrCols, "csv-attr-cols", nil, "CSV columns also set as message attributes")
+	pubCmd.Flags().StringVar(&kafkaDump, "kafka-dump", "", "Publish each record of this Kafka key/headers/value dump; see the README for the format")
+	pubCmd.Flags().StringVar(&profile, "profile", "", "Publish generated load in phases, eg: burst:1000,steady:100@1m; see the README")
+	pubCmd.Flags().BoolVar(&chunk, "chunk", false, "Split a payload larger than --chunk-size into chunk messages; reassemble with sub --reassemble")
+	pubCmd.Flags().IntVar(&chunkSize, "chunk-size", 5*1024*1024, "Largest payload in bytes published as one message with --chunk")
+	pubCmd.Flags().BoolVar(&pubRepeat, "repeat", false, "Publish --csv-file or --kafka-dump over and over until --count, --deadline or a signal")
+	pubCmd.Flags().IntVar(&pubCount, "count", 0, "Stop after publishing this many messages from --csv-file or --kafka-dump; 0 for no limit")
+	pubCmd.Flags().IntVar(&pubBatch, "batch", 100, "PubSub publishing batch sizes for --lines, --csv-file and --kafka-dump")
+	pubCmd.Flags().StringVar(&sequenceAttr, "sequence-attr", "", "Stamp an incrementing sequence number in this attribute on each message")
+	pubCmd.Flags().StringVar(&dedupKeyFrom, "dedup-key-from", "", "Set a dedup key attribute on each message: sha256 or md5 of the payload, or uuid")
+	pubCmd.Flags().StringVar(&dedupAttr, "dedup-attr", "dedup-key", "Attribute holding the --dedup-key-from key")
+	pubCmd.Flags().StringSliceVar(&routes, "route", nil, "Publish messages with attribute key=value to a topic, as key=value:topic; repeatable")
+	pubCmd.Flags().StringVar(&defaultTopic, "default-topic", "", "Topic for messages matching no --route; defaults to --topic")
+	pubCmd.Flags().DurationVar(&ttl, "ttl", 0, "Stamp an expires-at attribute this long after publishing, for consumers which drop stale messages")
+	pubCmd.Flags().StringSliceVar(&attrFromJSON, "attr-from-json", nil, "Set attribute key from the JSON payload, as key=$.path; repeatable")
+	pubCmd.Flags().StringVar(&partitionKeyFrom, "partition-key-from", "", "Stamp a partition attribute of FNV-1a(key) % --partitions, keyed on payload or attr:<name>")
+	pubCmd.Flags().IntVar(&partitions, "partitions", 1, "Number of partitions for --partition-key-from")
+	pubCmd.Flags().StringVar(&partitionAttr, "partition-attr", "partition", "Attribute holding the --partition-key-from partition")
+	pubCmd.Flags().StringVar(&errorsFile, "errors-file", "", "Write each message with its ID, or its error if it fails to publish, to this file as NDJSON, retrying failed batches one message at a time")
+	statsdFlags(pubCmd.Flags())
+	pubCmd.Flags().StringVar(&signKey, "sign-key", "", "Stamp a signature attribute holding the HMAC of each payload with this key")
+	pubCmd.Flags().StringVar(&hmacHash, "hmac-hash", "sha256", "Hash for --sign-key: sha1, sha256 or sha512")
+	pubCmd.Flags().StringVar(&contentType, "content-type", "", "Value of the content-type attribute set on published messages, eg: application/json")
 }
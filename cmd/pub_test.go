@@ -0,0 +1,290 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud"
+	"google.golang.org/cloud/pubsub"
+)
+
+// fakeTopic is a topic backed by a fake Pub/Sub API recording the messages
+// published to it. Batches holding a message whose data starts with "fail"
+// are rejected whole, as the API does.
+type fakeTopic struct {
+	*pubsub.Topic
+	mu        sync.Mutex
+	published []*pubsub.Message
+	batches   int
+}
+
+func newFakeTopic(t *testing.T) *fakeTopic {
+	ft := &fakeTopic{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Messages []struct {
+				Data       string            `json:"data"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var msgs []*pubsub.Message
+		for _, m := range req.Messages {
+			data, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil || strings.HasPrefix(string(data), "fail") {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": {"code": 400, "message": "rejected"}}`))
+				return
+			}
+			msgs = append(msgs, &pubsub.Message{Data: data, Attributes: m.Attributes})
+		}
+		ft.mu.Lock()
+		defer ft.mu.Unlock()
+		ft.batches++
+		ids := make([]string, len(msgs))
+		for i, m := range msgs {
+			ids[i] = strconv.Itoa(len(ft.published))
+			ft.published = append(ft.published, m)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"messageIds": ids})
+	}))
+	client, err := pubsub.NewClient(context.Background(), "project", cloud.WithEndpoint(srv.URL+"/"), cloud.WithBaseHTTP(http.DefaultClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.Topic = client.Topic("topic")
+	return ft
+}
+
+// data returns the data of the published messages.
+func (ft *fakeTopic) data() []string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	var data []string
+	for _, m := range ft.published {
+		data = append(data, string(m.Data))
+	}
+	return data
+}
+
+func TestNewRecordMessage(t *testing.T) {
+	defer func(from string, n int, seqAttr string, seq int64, ct string) {
+		partitionKeyFrom, partitions, sequenceAttr, sequence, contentType = from, n, seqAttr, seq, ct
+	}(partitionKeyFrom, partitions, sequenceAttr, sequence, contentType)
+	partitionKeyFrom, partitions, sequenceAttr, sequence, contentType = "attr:region", 4, "seq", 0, "text/csv"
+
+	msg, err := newRecordMessage([]byte("row"), map[string]string{
+		"region":       "eu",
+		"seq":          "99",
+		"content-type": "text/plain",
+		signatureAttr:  "forged",
+		chunkIDAttr:    "c",
+		"other":        "kept",
+	})
+	if err != nil {
+		t.Fatalf("newRecordMessage: %v", err)
+	}
+	want := map[string]string{
+		"region":       "eu",
+		"seq":          "1",
+		"content-type": "text/csv",
+		partitionAttr:  strconv.Itoa(partition([]byte("eu"), 4)),
+		"other":        "kept",
+	}
+	if len(msg.Attributes) != len(want) {
+		t.Errorf("attributes = %v, want %v", msg.Attributes, want)
+	}
+	for k, v := range want {
+		if msg.Attributes[k] != v {
+			t.Errorf("attribute %s = %q, want %q", k, msg.Attributes[k], v)
+		}
+	}
+
+	if _, err := newRecordMessage([]byte("row"), map[string]string{"other": "x"}); err == nil {
+		t.Error("newRecordMessage without the partition key attribute succeeded")
+	}
+}
+
+func TestPublishChunked(t *testing.T) {
+	defer func(c bool, size, batch int, delim, ct string, ctx context.Context) {
+		chunk, chunkSize, pubBatch, delimiter, contentType, rootCtx = c, size, batch, delim, ct, ctx
+	}(chunk, chunkSize, pubBatch, delimiter, contentType, rootCtx)
+	chunk, chunkSize, pubBatch, delimiter, contentType, rootCtx = true, 4, 10, "\n", "text/plain", context.Background()
+
+	want := []string{"one", "long", " lin", "e", "two"}
+
+	ft := newFakeTopic(t)
+	if n := publishLines(context.Background(), ft.Topic, strings.NewReader("one\nlong line\ntwo\n")); n != 3 {
+		t.Errorf("publishLines published %d, want 3", n)
+	}
+	if got := ft.data(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("publishLines published %q, want %q", got, want)
+	}
+	for _, m := range ft.published {
+		if m.Attributes["content-type"] != contentType {
+			t.Errorf("message %q has content-type %q, want %q", m.Data, m.Attributes["content-type"], contentType)
+		}
+	}
+
+	ft = newFakeTopic(t)
+	p := &filePublisher{ctx: context.Background(), topic: ft.Topic}
+	for _, d := range []string{"one", "long line", "two"} {
+		p.Add(fileRecord{data: []byte(d), where: d})
+	}
+	p.Flush()
+	if p.published != 3 || p.failed != 0 {
+		t.Errorf("filePublisher published %d and failed %d, want 3 and 0", p.published, p.failed)
+	}
+	if got := ft.data(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("filePublisher published %q, want %q", got, want)
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     string
+		wantErr  bool
+	}{
+		{"sha256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", false},
+		{"md5", "5d41402abc4b2a76b9719d911017c592", false},
+		{"crc32", "", true},
+	}
+	for _, tt := range tests {
+		got, err := dedupKey(tt.strategy, []byte("hello"))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("dedupKey(%q) = %q, %v, want %q, error %v", tt.strategy, got, err, tt.want, tt.wantErr)
+		}
+	}
+	a, _ := dedupKey("uuid", []byte("hello"))
+	b, _ := dedupKey("uuid", []byte("hello"))
+	if a == "" || a == b {
+		t.Errorf("uuid dedup keys %q and %q, want distinct", a, b)
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	attrs := map[string]string{"region": "eu"}
+	tests := []struct {
+		from    string
+		valid   bool
+		want    string
+		wantErr bool
+	}{
+		{"payload", true, "data", false},
+		{"attr:region", true, "eu", false},
+		{"attr:zone", true, "", true},
+		{"attr:", false, "", false},
+		{"header", false, "", false},
+	}
+	for _, tt := range tests {
+		if got := validPartitionKeyFrom(tt.from); got != tt.valid {
+			t.Errorf("validPartitionKeyFrom(%q) = %v, want %v", tt.from, got, tt.valid)
+		}
+		if !tt.valid {
+			continue
+		}
+		got, err := partitionKey(tt.from, []byte("data"), attrs)
+		if (err != nil) != tt.wantErr || string(got) != tt.want {
+			t.Errorf("partitionKey(%q) = %q, %v, want %q, error %v", tt.from, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	for n := 1; n < 8; n++ {
+		if p := partition([]byte("key"), n); p < 0 || p >= n {
+			t.Errorf("partition of %d = %d, want in [0, %d)", n, p, n)
+		}
+	}
+
+	// Distinct keys should spread within 10% of an even share.
+	const keys = 100000
+	for _, n := range []int{2, 3, 8, 16, 31} {
+		counts := make([]int, n)
+		for i := 0; i < keys; i++ {
+			counts[partition([]byte("user-"+strconv.Itoa(i)), n)]++
+		}
+		even := keys / n
+		for p, c := range counts {
+			if c < even*9/10 || c > even*11/10 {
+				t.Errorf("%d partitions: partition %d got %d keys, want %d ± 10%%", n, p, c, even)
+			}
+		}
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{`\n`, "\n", false},
+		{`\x00`, "\x00", false},
+		{`\t|\t`, "\t|\t", false},
+		{`\r\n`, "\r\n", false},
+		{` `, " ", false},
+		{`"`, `"`, false},
+		{`--`, "--", false},
+		{``, "", true},
+		{`\`, "", true},
+		{`\q`, "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseDelimiter(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseDelimiter(%q) = %q, %v, want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		in, delim string
+		want      []string
+	}{
+		{"a\nb\n", "\n", []string{"a", "b"}},
+		{"a\nb", "\n", []string{"a", "b"}},
+		{"a\n\nb\n\n", "\n", []string{"a", "b"}},
+		{"", "\n", nil},
+		{"\n", "\n", nil},
+		{"one\ntwo\x00three\x00", "\x00", []string{"one\ntwo", "three"}},
+		{"a--b-c---d--", "--", []string{"a", "b-c", "-d"}},
+		{"a--b-", "--", []string{"a", "b-"}},
+		{"a\r\nb\nc\r\n", "\r\n", []string{"a", "b\nc"}},
+		{"x y ", " ", []string{"x", "y"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for line := range readLines(strings.NewReader(tt.in), tt.delim) {
+			got = append(got, line)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("readLines(%q, %q) = %q, want %q", tt.in, tt.delim, got, tt.want)
+		}
+	}
+}
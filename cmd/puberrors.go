@@ -0,0 +1,107 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+// publishRecord is the outcome of publishing a message, as written to
+// --errors-file: its ID once published, or the error for retry.
+type publishRecord struct {
+	Topic      string            `json:"topic"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	ID         string            `json:"id,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// publishErrors writes a publishRecord per message as NDJSON.
+type publishErrors struct {
+	enc    *json.Encoder
+	failed int
+}
+
+func newPublishErrors(w io.Writer) *publishErrors {
+	return &publishErrors{enc: json.NewEncoder(w)}
+}
+
+// Published writes m, which was published to topic as id.
+func (pe *publishErrors) Published(topic *pubsub.Topic, m *pubsub.Message, id string) {
+	pe.write(&publishRecord{Topic: topic.Name(), Data: m.Data, Attributes: m.Attributes, ID: id})
+}
+
+// Record writes m, which failed to publish to topic with err.
+func (pe *publishErrors) Record(topic *pubsub.Topic, m *pubsub.Message, err error) {
+	pe.failed++
+	pe.write(&publishRecord{Topic: topic.Name(), Data: m.Data, Attributes: m.Attributes, Error: err.Error()})
+}
+
+func (pe *publishErrors) write(r *publishRecord) {
+	if err := pe.enc.Encode(r); err != nil {
+		log.Errorf("error recording publish result: %v", err)
+	}
+}
+
+// publishTo publishes msgs to topic, logging any error, and returns the
+// number of messages published. With --errors-file every message is
+// recorded with its ID or error. The API accepts or rejects a batch whole,
+// so a failed batch is retried one message at a time and only the messages
+// which still fail, eg: oversized ones, are recorded as failed.
+func publishTo(ctx context.Context, topic *pubsub.Topic, msgs []*pubsub.Message) int {
+	start := time.Now()
+	ids, err := topic.Publish(ctx, msgs...)
+	stats.Timing("publish.latency", time.Since(start))
+	if err == nil {
+		log.Debugf("Message IDs\n%#v", ids)
+		stats.Incr("published", int64(len(ids)))
+		if pubErrors != nil {
+			for i, id := range ids {
+				pubErrors.Published(topic, msgs[i], id)
+			}
+		}
+		return len(ids)
+	}
+	stats.Incr("publish.errors", 1)
+	log.Errorf("error publishing %d messages to %s: %v", len(msgs), topic.Name(), err)
+	if pubErrors == nil {
+		return 0
+	}
+	if len(msgs) == 1 {
+		pubErrors.Record(topic, msgs[0], err)
+		return 0
+	}
+
+	published := 0
+	for _, m := range msgs {
+		ids, err := topic.Publish(ctx, m)
+		if err != nil {
+			pubErrors.Record(topic, m, err)
+			continue
+		}
+		log.Debugf("Message ID %s", ids[0])
+		pubErrors.Published(topic, m, ids[0])
+		published++
+	}
+	stats.Incr("published", int64(published))
+	log.Infof("Published %d of %d messages individually after batch error", published, len(msgs))
+	return published
+}
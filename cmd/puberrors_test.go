@@ -0,0 +1,114 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+func TestPublishErrorsMixedBatch(t *testing.T) {
+	defer func(pe *publishErrors) { pubErrors = pe }(pubErrors)
+	var buf bytes.Buffer
+	pubErrors = newPublishErrors(&buf)
+
+	ft := newFakeTopic(t)
+	msgs := []*pubsub.Message{
+		{Data: []byte("one")},
+		{Data: []byte("fail two"), Attributes: map[string]string{"k": "v"}},
+		{Data: []byte("three")},
+		{Data: []byte("fail four")},
+	}
+	if n := publishTo(context.Background(), ft.Topic, msgs); n != 2 {
+		t.Errorf("publishTo = %d, want 2", n)
+	}
+	if got := strings.Join(ft.data(), ","); got != "one,three" {
+		t.Errorf("published %s, want one,three", got)
+	}
+	if pubErrors.failed != 2 {
+		t.Errorf("recorded %d failures, want 2", pubErrors.failed)
+	}
+
+	records := readPublishRecords(t, &buf)
+	if len(records) != 4 {
+		t.Fatalf("--errors-file has %d records, want 4", len(records))
+	}
+	for i, want := range []struct {
+		data   string
+		failed bool
+	}{{"one", false}, {"fail two", true}, {"three", false}, {"fail four", true}} {
+		r := records[i]
+		if string(r.Data) != want.data || !strings.HasSuffix(r.Topic, "/topic") {
+			t.Errorf("record %d = %+v, want %q on topic", i, r, want.data)
+		}
+		if want.failed && (r.Error == "" || r.ID != "") {
+			t.Errorf("record %d = %+v, want an error and no ID", i, r)
+		}
+		if !want.failed && (r.Error != "" || r.ID == "") {
+			t.Errorf("record %d = %+v, want an ID and no error", i, r)
+		}
+	}
+	if records[1].Attributes["k"] != "v" {
+		t.Errorf("record 1 attributes = %v, want k=v", records[1].Attributes)
+	}
+}
+
+// readPublishRecords decodes the --errors-file NDJSON in r.
+func readPublishRecords(t *testing.T, r io.Reader) []publishRecord {
+	var records []publishRecord
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var pr publishRecord
+		if err := dec.Decode(&pr); err != nil {
+			t.Fatalf("decoding --errors-file: %v", err)
+		}
+		records = append(records, pr)
+	}
+	return records
+}
+
+func TestPublishErrorsSuccess(t *testing.T) {
+	defer func(pe *publishErrors) { pubErrors = pe }(pubErrors)
+	var buf bytes.Buffer
+	pubErrors = newPublishErrors(&buf)
+
+	ft := newFakeTopic(t)
+	msgs := []*pubsub.Message{{Data: []byte("one")}, {Data: []byte("two")}}
+	if n := publishTo(context.Background(), ft.Topic, msgs); n != 2 {
+		t.Errorf("publishTo = %d, want 2", n)
+	}
+	if ft.batches != 1 {
+		t.Errorf("published in %d batches, want 1", ft.batches)
+	}
+	records := readPublishRecords(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("--errors-file has %d records, want 2", len(records))
+	}
+	for i, r := range records {
+		if r.ID != strconv.Itoa(i) || r.Error != "" {
+			t.Errorf("record %d = %+v, want ID %d and no error", i, r, i)
+		}
+	}
+	if pubErrors.failed != 0 {
+		t.Errorf("recorded %d failures, want 0", pubErrors.failed)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+var (
+	// reconnectBase is the backoff ceiling before the first reconnection,
+	// doubling with each consecutive attempt up to reconnectMaxDelay.
+	reconnectBase     time.Duration
+	reconnectMaxDelay time.Duration
+)
+
+// messageIterator is the part of pubsub.Iterator the reconnecting iterator
+// uses.
+type messageIterator interface {
+	Next() (*pubsub.Message, error)
+	Stop()
+}
+
+// reconnectingIterator wraps a subscription's Iterator, stopping it and
+// pulling a new one with backoff when Next returns an error other than Done.
+type reconnectingIterator struct {
+	pull        func() (messageIterator, error)
+	maxAttempts int
+	rng         *rand.Rand
+	// sleep waits out the backoff before each reconnection; time.After
+	// unless a test replaces it.
+	sleep func(time.Duration) <-chan time.Time
+	// beforeReconnect, when set, is called before the failed iterator is
+	// stopped, which blocks until every message it returned is Done.
+	beforeReconnect func()
+
+	mu      sync.Mutex
+	it      messageIterator
+	stopped chan struct{}
+}
+
+// newReconnectingIterator starts pulling from sub. maxAttempts bounds the
+// consecutive reconnections made before Next returns the error; 0 disables
+// reconnecting.
+func newReconnectingIterator(sub *pubsub.Subscription, maxAttempts int) (*reconnectingIterator, error) {
+	// Each iterator has its own context so pending acks are still sent
+	// after rootCtx is cancelled; Stop aborts any pull in flight.
+	return startReconnectingIterator(func() (messageIterator, error) {
+		return sub.Pull(context.Background(), pubsub.MaxExtension(time.Minute*1))
+	}, maxAttempts)
+}
+
+// startReconnectingIterator starts pulling from the iterators created by
+// pull.
+func startReconnectingIterator(pull func() (messageIterator, error), maxAttempts int) (*reconnectingIterator, error) {
+	r := &reconnectingIterator{
+		pull:        pull,
+		maxAttempts: maxAttempts,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		sleep:       time.After,
+		stopped:     make(chan struct{}),
+	}
+	it, err := r.pull()
+	if err != nil {
+		return nil, err
+	}
+	r.it = it
+	return r, nil
+}
+
+// Next returns the next message, reconnecting after errors until
+// maxAttempts consecutive reconnections have failed, when it returns the
+// last error.
+func (r *reconnectingIterator) Next() (*pubsub.Message, error) {
+	var pullErr error
+	for attempt := 1; ; attempt++ {
+		r.mu.Lock()
+		it := r.it
+		r.mu.Unlock()
+		select {
+		case <-r.stopped:
+			return nil, pubsub.Done
+		default:
+		}
+
+		// it is nil when the last reconnection failed to pull.
+		err := pullErr
+		if it != nil {
+			var m *pubsub.Message
+			if m, err = it.Next(); err == nil || err == pubsub.Done {
+				return m, err
+			}
+		}
+		if attempt > r.maxAttempts {
+			return nil, err
+		}
+
+		delay := reconnectDelay(attempt, r.rng)
+		log.Warnf("error reading from iterator: %v; reconnecting in %v (attempt %d/%d)", err, delay, attempt, r.maxAttempts)
+		select {
+		case <-r.sleep(delay):
+		case <-r.stopped:
+			return nil, pubsub.Done
+		}
+
+		if r.beforeReconnect != nil {
+			r.beforeReconnect()
+		}
+		// Stopping blocks until the failed iterator's messages are Done,
+		// so it's done without holding mu.
+		r.mu.Lock()
+		old := r.it
+		r.it = nil
+		r.mu.Unlock()
+		if old != nil {
+			old.Stop()
+		}
+		var next messageIterator
+		if next, pullErr = r.pull(); pullErr != nil {
+			log.Errorf("error creating pubsub iterator: %v", pullErr)
+			next = nil
+		}
+
+		r.mu.Lock()
+		select {
+		case <-r.stopped:
+			r.mu.Unlock()
+			if next != nil {
+				next.Stop()
+			}
+			return nil, pubsub.Done
+		default:
+		}
+		r.it = next
+		r.mu.Unlock()
+	}
+}
+
+// Stop stops the current iterator and any reconnection in progress.
+func (r *reconnectingIterator) Stop() {
+	r.mu.Lock()
+	select {
+	case <-r.stopped:
+	default:
+		close(r.stopped)
+	}
+	it := r.it
+	r.it = nil
+	r.mu.Unlock()
+	if it != nil {
+		it.Stop()
+	}
+}
+
+// reconnectCeiling returns the longest backoff before the given attempt:
+// base doubled for each attempt after the first, capped at max.
+func reconnectCeiling(attempt int, base, max time.Duration) time.Duration {
+	shift := uint(attempt - 1)
+	if shift >= 62 {
+		return max
+	}
+	d := base << shift
+	if d <= 0 || d>>shift != base || d > max {
+		return max
+	}
+	return d
+}
+
+// reconnectDelay returns a full jitter backoff before the given attempt,
+// chosen uniformly between 0 and its ceiling, so many consumers recovering
+// from the same outage don't reconnect in lockstep.
+func reconnectDelay(attempt int, rng *rand.Rand) time.Duration {
+	ceiling := reconnectCeiling(attempt, reconnectBase, reconnectMaxDelay)
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(int64(ceiling) + 1))
+}
@@ -0,0 +1,208 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"google.golang.org/cloud/pubsub"
+)
+
+var errPull = errors.New("pull failed")
+
+// fakeIterator returns err from Next, or msg when err is nil, and like
+// pubsub.Iterator returns Done once stopped.
+type fakeIterator struct {
+	msg     *pubsub.Message
+	err     error
+	stopped bool
+}
+
+func (f *fakeIterator) Next() (*pubsub.Message, error) {
+	if f.stopped {
+		return nil, pubsub.Done
+	}
+	return f.msg, f.err
+}
+
+func (f *fakeIterator) Stop() { f.stopped = true }
+
+// fakePulls returns a pull func handing out the given iterators in order,
+// failing with errPull for nil entries, and a count of the calls made.
+func fakePulls(its ...*fakeIterator) (func() (messageIterator, error), *int) {
+	calls := 0
+	return func() (messageIterator, error) {
+		it := its[calls]
+		calls++
+		if it == nil {
+			return nil, errPull
+		}
+		return it, nil
+	}, &calls
+}
+
+// noReconnectDelay disables the reconnection backoff, returning a func
+// restoring it.
+func noReconnectDelay() func() {
+	base, max := reconnectBase, reconnectMaxDelay
+	reconnectBase, reconnectMaxDelay = 0, 0
+	return func() { reconnectBase, reconnectMaxDelay = base, max }
+}
+
+func TestReconnectingIterator(t *testing.T) {
+	defer noReconnectDelay()()
+
+	msg := &pubsub.Message{ID: "1"}
+	failing := func() *fakeIterator { return &fakeIterator{err: errPull} }
+	tests := []struct {
+		name        string
+		maxAttempts int
+		its         []*fakeIterator
+		wantErr     error
+		wantPulls   int
+	}{
+		{"message", 3, []*fakeIterator{{msg: msg}}, nil, 1},
+		{"done", 3, []*fakeIterator{{err: pubsub.Done}}, pubsub.Done, 1},
+		{"no reconnect", 0, []*fakeIterator{failing()}, errPull, 1},
+		{"recovers", 3, []*fakeIterator{failing(), failing(), {msg: msg}}, nil, 3},
+		{"recovers after failed pull", 3, []*fakeIterator{failing(), nil, {msg: msg}}, nil, 3},
+		{"exhausted", 2, []*fakeIterator{failing(), failing(), failing()}, errPull, 3},
+		{"exhausted by failed pulls", 2, []*fakeIterator{failing(), nil, nil}, errPull, 3},
+	}
+	for _, tt := range tests {
+		pull, calls := fakePulls(tt.its...)
+		r, err := startReconnectingIterator(pull, tt.maxAttempts)
+		if err != nil {
+			t.Fatalf("%s: startReconnectingIterator: %v", tt.name, err)
+		}
+		m, err := r.Next()
+		if err != tt.wantErr {
+			t.Errorf("%s: Next error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if tt.wantErr == nil && m != msg {
+			t.Errorf("%s: Next = %v, want %v", tt.name, m, msg)
+		}
+		if *calls != tt.wantPulls {
+			t.Errorf("%s: %d pulls, want %d", tt.name, *calls, tt.wantPulls)
+		}
+		r.Stop()
+		if m, err := r.Next(); m != nil || err != pubsub.Done {
+			t.Errorf("%s: Next after Stop = %v, %v, want Done", tt.name, m, err)
+		}
+	}
+}
+
+func TestReconnectingIteratorBeforeReconnect(t *testing.T) {
+	defer noReconnectDelay()()
+	first := &fakeIterator{err: errPull}
+	pull, _ := fakePulls(first, &fakeIterator{msg: &pubsub.Message{}})
+	r, err := startReconnectingIterator(pull, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stoppedBefore bool
+	r.beforeReconnect = func() { stoppedBefore = first.stopped }
+	if _, err := r.Next(); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if stoppedBefore {
+		t.Error("beforeReconnect called after the failed iterator was stopped")
+	}
+	if !first.stopped {
+		t.Error("failed iterator was not stopped")
+	}
+}
+
+func TestReconnectCeiling(t *testing.T) {
+	tests := []struct {
+		attempt   int
+		base, max time.Duration
+		want      time.Duration
+	}{
+		{1, time.Second, time.Minute, time.Second},
+		{2, time.Second, time.Minute, 2 * time.Second},
+		{6, time.Second, time.Minute, 32 * time.Second},
+		{7, time.Second, time.Minute, time.Minute},
+		{62, time.Second, time.Minute, time.Minute},
+		{1000, time.Second, time.Minute, time.Minute},
+		{40, time.Hour, math.MaxInt64, math.MaxInt64},
+	}
+	for _, tt := range tests {
+		if got := reconnectCeiling(tt.attempt, tt.base, tt.max); got != tt.want {
+			t.Errorf("reconnectCeiling(%d, %v, %v) = %v, want %v", tt.attempt, tt.base, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestReconnectDelayJitter(t *testing.T) {
+	defer noReconnectDelay()()
+	reconnectBase, reconnectMaxDelay = 10*time.Millisecond, 80*time.Millisecond
+
+	rng := rand.New(rand.NewSource(1))
+	for attempt := 1; attempt <= 8; attempt++ {
+		ceiling := reconnectCeiling(attempt, reconnectBase, reconnectMaxDelay)
+		var below bool
+		for i := 0; i < 1000; i++ {
+			d := reconnectDelay(attempt, rng)
+			if d < 0 || d > ceiling {
+				t.Fatalf("attempt %d: delay %v outside [0, %v]", attempt, d, ceiling)
+			}
+			below = below || d < ceiling/2
+		}
+		if !below {
+			t.Errorf("attempt %d: no delay below half the ceiling %v, want full jitter", attempt, ceiling)
+		}
+	}
+}
+
+func TestReconnectingIteratorBackoff(t *testing.T) {
+	defer noReconnectDelay()()
+	reconnectBase, reconnectMaxDelay = time.Second, 4*time.Second
+
+	var its []*fakeIterator
+	for i := 0; i < 6; i++ {
+		its = append(its, &fakeIterator{err: errPull})
+	}
+	pull, _ := fakePulls(its...)
+	r, err := startReconnectingIterator(pull, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delays []time.Duration
+	r.sleep = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		c := make(chan time.Time, 1)
+		c <- time.Time{}
+		return c
+	}
+	if _, err := r.Next(); err != errPull {
+		t.Fatalf("Next error = %v, want %v", err, errPull)
+	}
+	if len(delays) != 5 {
+		t.Fatalf("slept %d times, want 5", len(delays))
+	}
+	for i, d := range delays {
+		if ceiling := reconnectCeiling(i+1, reconnectBase, reconnectMaxDelay); d < 0 || d > ceiling {
+			t.Errorf("attempt %d: delay %v outside [0, %v]", i+1, d, ceiling)
+		}
+		if d > reconnectMaxDelay {
+			t.Errorf("attempt %d: delay %v above the %v cap", i+1, d, reconnectMaxDelay)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+var (
+	pubRepeat bool
+	pubCount  int
+)
+
+// repeatCacheLimit is the largest input file --repeat keeps in memory
+// rather than re-reading it each iteration.
+const repeatCacheLimit = 64 * 1024 * 1024
+
+// fileRecord is the payload and attributes of one message read from
+// --csv-file or --kafka-dump, before newMessage stamps it.
+type fileRecord struct {
+	data  []byte
+	attrs map[string]string
+	where string // position in the file, for errors
+}
+
+// fileReader reads the records of the file at path, passing each to add
+// until add returns false, and returns how many failed to parse.
+type fileReader func(path string, add func(fileRecord) bool) (failed int, err error)
+
+// filePublisher publishes records in batches of pubBatch, stopping once
+// limit messages have been published, when limit is positive, or rootCtx is
+// cancelled.
+type filePublisher struct {
+	ctx       context.Context
+	topic     *pubsub.Topic
+	limit     int
+	msgs      []*pubsub.Message
+	published int
+	failed    int
+}
+
+// Add queues rec for publishing, reporting whether to keep reading.
+func (p *filePublisher) Add(rec fileRecord) bool {
+	if p.done() {
+		return false
+	}
+	msg, err := newRecordMessage(rec.data, rec.attrs)
+	if err != nil {
+		log.Errorf("error on %s: %v", rec.where, err)
+		p.failed++
+		return true
+	}
+	if chunk {
+		if chunks := chunkMessage(msg, chunkSize); len(chunks) > 1 {
+			// Queued messages go first to keep the file's order.
+			p.Flush()
+			if n := publishChunks(p.ctx, p.topic, chunks); n < len(chunks) {
+				log.Errorf("error on %s: published %d of %d chunks", rec.where, n, len(chunks))
+				p.failed++
+			} else {
+				p.published++
+			}
+			return true
+		}
+	}
+	p.msgs = append(p.msgs, msg)
+	if len(p.msgs) >= pubBatch {
+		p.Flush()
+	}
+	return true
+}
+
+// Flush publishes any queued messages.
+func (p *filePublisher) Flush() {
+	p.published += publishBatch(p.ctx, p.topic, p.msgs)
+	p.msgs = p.msgs[:0]
+}
+
+func (p *filePublisher) done() bool {
+	return rootCtx.Err() != nil || (p.limit > 0 && p.published+len(p.msgs) >= p.limit)
+}
+
+// publishFile publishes the records read from path by read, stopping after
+// --count messages when set, and returns how many were published and how
+// many failed.
+func publishFile(ctx context.Context, topic *pubsub.Topic, path string, read fileReader) (published, failed int, err error) {
+	p := &filePublisher{ctx: ctx, topic: topic, limit: pubCount, msgs: make([]*pubsub.Message, 0, pubBatch)}
+	if pubRepeat {
+		failed, err = repeatFile(p, path, read)
+	} else {
+		failed, err = read(path, p.Add)
+	}
+	p.Flush()
+	return p.published, failed + p.failed, err
+}
+
+// repeatFile adds the records of path to p over and over until --count or
+// rootCtx stops it. Files up to repeatCacheLimit are read once and replayed
+// from memory. Records are stamped afresh by newMessage on every pass, and
+// parse failures are counted on the first pass only.
+func repeatFile(p *filePublisher, path string, read fileReader) (failed int, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	cacheable := fi.Size() <= repeatCacheLimit
+	var cache []fileRecord
+	iterations := 0
+	for !p.done() {
+		if iterations > 0 && cacheable {
+			for _, rec := range cache {
+				if !p.Add(rec) {
+					break
+				}
+			}
+			iterations++
+			continue
+		}
+
+		records := 0
+		n, err := read(path, func(rec fileRecord) bool {
+			records++
+			if cacheable {
+				cache = append(cache, rec)
+			}
+			return p.Add(rec)
+		})
+		if iterations == 0 {
+			failed = n
+		}
+		if err != nil {
+			return failed, err
+		}
+		if records == 0 {
+			return failed, fmt.Errorf("%s has no records to repeat", path)
+		}
+		iterations++
+	}
+	log.Infof("Repeated %s %d times", path, iterations)
+	return failed, nil
+}
@@ -18,20 +18,44 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/lytics/cloudstorage"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/net/context"
 	"google.golang.org/cloud/compute/metadata"
 )
 
+// envPrefix is prepended to the upper-cased flag name when looking up
+// environment overrides, eg: PUBBING_TOPIC.
+const envPrefix = "PUBBING_"
+
 var (
-	GC         *http.Client
-	Gceproject string
-	Topic      string
-	KeyPath    string
-	Loglvl     string
-	Logfmt     string
+	GC            *http.Client
+	Gceproject    string
+	Topic         string
+	KeyPath       string
+	Loglvl        string
+	Logfmt        string
+	Logcolor      string
+	LogFile       string
+	LogAlsoStderr bool
+	ConnPool      int
+	ClientCert    string
+	ClientKey     string
+	WaitForTopic  time.Duration
+	Deadline      time.Duration
+	TokenEarly    time.Duration
+
+	// rootCtx is shared by all subcommands and is cancelled when a kill
+	// signal is caught.
+	rootCtx    context.Context
+	rootCancel context.CancelFunc
 )
 
 func GCS(projectid string) cloudstorage.GoogleOAuthClient {
@@ -66,6 +90,67 @@ func logsetup() {
 	log.Debugf("Logfmt: %s", Logfmt)
 	if Logfmt == "json" {
 		log.SetFormatter(&log.JSONFormatter{})
+		return
+	}
+
+	// auto leaves logrus to color output only when stdout is a terminal.
+	switch Logcolor {
+	case "always":
+		log.SetFormatter(&log.TextFormatter{ForceColors: true})
+	case "never":
+		log.SetFormatter(&log.TextFormatter{DisableColors: true})
+	case "auto":
+	default:
+		log.Errorf("unknown color mode: %s", Logcolor)
+	}
+}
+
+// signalContext returns a child of parent which is cancelled when the
+// process receives SIGINT, SIGTERM or SIGQUIT.
+func signalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		select {
+		case s := <-sigs:
+			log.Warnf("quit signal caught: %v", s)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+// deadlineContext returns a child of parent which is cancelled after
+// timeout, logging when the deadline is what ended it.
+func deadlineContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Warnf("deadline of %v exceeded, shutting down", timeout)
+		}
+	}()
+	return ctx, cancel
+}
+
+// bindEnv sets each named flag which wasn't given on the command line from
+// its PUBBING_<NAME> environment variable. Flags take precedence over env.
+func bindEnv(flags *pflag.FlagSet, names ...string) {
+	for _, name := range names {
+		f := flags.Lookup(name)
+		if f == nil || f.Changed {
+			continue
+		}
+		key := envPrefix + strings.ToUpper(name)
+		if v, ok := os.LookupEnv(key); ok {
+			if err := f.Value.Set(v); err != nil {
+				log.Errorf("error setting --%s from %s: %v", name, key, err)
+				os.Exit(1)
+			}
+		}
 	}
 }
 
@@ -90,6 +175,15 @@ func rootinit(Cmd *cobra.Command) {
 	RootCmd.PersistentFlags().StringVar(&KeyPath, "key", "", "PubSub service account key path")
 	RootCmd.PersistentFlags().StringVar(&Loglvl, "log", "info", "logging level; debug,info,warn,error")
 	RootCmd.PersistentFlags().StringVar(&Logfmt, "logfmt", "text", "logging format: text,json")
+	RootCmd.PersistentFlags().StringVar(&LogFile, "log-file", "", "append logs to this file instead of stdout; reopened on SIGHUP")
+	RootCmd.PersistentFlags().BoolVar(&LogAlsoStderr, "log-also-stderr", false, "with --log-file, also write logs to stderr")
+	RootCmd.PersistentFlags().StringVar(&Logcolor, "color", "auto", "colorize text logs: auto,always,never")
+	RootCmd.PersistentFlags().StringVar(&ClientCert, "client-cert", "", "PEM client certificate presented to mutual TLS proxies")
+	RootCmd.PersistentFlags().StringVar(&ClientKey, "client-key", "", "PEM private key for --client-cert")
+	RootCmd.PersistentFlags().DurationVar(&TokenEarly, "token-refresh-early", 0, "Refresh oauth tokens this long before they expire; 0 uses the library's 10s")
+	RootCmd.PersistentFlags().DurationVar(&Deadline, "deadline", 0, "Shut down gracefully after this long, as if signalled; 0 runs until done")
+	RootCmd.PersistentFlags().DurationVar(&WaitForTopic, "wait-for-topic", 0, "Wait up to this long for the topic to exist before starting")
+	RootCmd.PersistentFlags().IntVar(&ConnPool, "conn-pool", 0, "Idle HTTP connections kept open to the PubSub API; 0 uses the library default")
 }
 
 // This represents the base command when called without any subcommands
@@ -97,6 +191,30 @@ var RootCmd = &cobra.Command{
 	Use:   "pubbing",
 	Short: "Google PubSub test framework",
 	Long:  ``,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		bindEnv(cmd.Flags(), "project", "topic", "sub")
+		inferProject()
+		logFieldsSetup(cmd)
+		if LogAlsoStderr && LogFile == "" {
+			log.Errorf("--log-also-stderr needs --log-file")
+			os.Exit(1)
+		}
+		logFileSetup()
+		if TokenEarly >= maxTokenLifetime {
+			log.Errorf("--token-refresh-early must be shorter than the %v token lifetime", maxTokenLifetime)
+			os.Exit(1)
+		}
+		rootCtx, rootCancel = signalContext(context.Background())
+		if Deadline > 0 {
+			sigCancel := rootCancel
+			var cancel context.CancelFunc
+			rootCtx, cancel = deadlineContext(rootCtx, Deadline)
+			rootCancel = func() {
+				cancel()
+				sigCancel()
+			}
+		}
+	},
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) { log.Infof("pubbing called without command") },
@@ -119,7 +237,11 @@ func init() {
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	err := RootCmd.Execute()
+	if rootCancel != nil {
+		rootCancel()
+	}
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
@@ -0,0 +1,93 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/spf13/pflag"
+)
+
+func TestBindEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"default", nil, nil, "default-topic"},
+		{"env", map[string]string{"PUBBING_TOPIC": "env-topic"}, nil, "env-topic"},
+		{"empty env", map[string]string{"PUBBING_TOPIC": ""}, nil, ""},
+		{"flag", nil, []string{"--topic=flag-topic"}, "flag-topic"},
+		{"flag over env", map[string]string{"PUBBING_TOPIC": "env-topic"}, []string{"--topic=flag-topic"}, "flag-topic"},
+		{"other env", map[string]string{"PUBBING_SUB": "env-sub"}, nil, "default-topic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var topic string
+			flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			flags.StringVar(&topic, "topic", "default-topic", "")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			bindEnv(flags, "topic", "missing")
+			if topic != tt.want {
+				t.Errorf("topic = %q, want %q", topic, tt.want)
+			}
+		})
+	}
+}
+
+func TestRootCmdTopicEnv(t *testing.T) {
+	defer func(topic string, ctx context.Context) { Topic, rootCtx = topic, ctx }(Topic, rootCtx)
+	reset := func() {
+		for _, name := range []string{"topic", "log"} {
+			f := RootCmd.PersistentFlags().Lookup(name)
+			f.Value.Set(f.DefValue)
+			f.Changed = false
+		}
+	}
+	defer reset()
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		// Without args cobra parses os.Args, so give it a flag at its default.
+		{"env", []string{"--log=info"}, "env-topic"},
+		{"flag over env", []string{"--topic=flag-topic"}, "flag-topic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PUBBING_TOPIC", "env-topic")
+			reset()
+			RootCmd.SetArgs(tt.args)
+			defer RootCmd.SetArgs(nil)
+			if err := RootCmd.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			rootCancel()
+			if Topic != tt.want {
+				t.Errorf("Topic = %q, want %q", Topic, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+// routeRule sends messages whose attribute key equals value to topic.
+type routeRule struct {
+	key   string
+	value string
+	topic string
+}
+
+// parseRoute parses a --route rule of the form key=value:topic. Topic names
+// can't contain a colon, so the value may.
+func parseRoute(spec string) (routeRule, error) {
+	i := strings.LastIndex(spec, ":")
+	j := strings.Index(spec, "=")
+	if i < 0 || j < 0 || j > i {
+		return routeRule{}, fmt.Errorf("invalid route %q: want key=value:topic", spec)
+	}
+	r := routeRule{key: spec[:j], value: spec[j+1 : i], topic: spec[i+1:]}
+	if r.key == "" || r.topic == "" {
+		return routeRule{}, fmt.Errorf("invalid route %q: key and topic must be set", spec)
+	}
+	return r, nil
+}
+
+// router publishes each message to the topic of the first rule matching its
+// attributes, or to the fallback topic, counting messages per destination.
+type router struct {
+	rules    []routeRule
+	fallback string
+	topics   map[string]*pubsub.Topic
+	counts   map[string]int
+}
+
+func newRouter(client *pubsub.Client, specs []string, fallback string) (*router, error) {
+	r := &router{
+		fallback: fallback,
+		topics:   map[string]*pubsub.Topic{fallback: client.Topic(fallback)},
+		counts:   map[string]int{},
+	}
+	for _, spec := range specs {
+		rule, err := parseRoute(spec)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+		if _, ok := r.topics[rule.topic]; !ok {
+			r.topics[rule.topic] = client.Topic(rule.topic)
+		}
+	}
+	return r, nil
+}
+
+// route returns the name of the topic m should be published to.
+func (r *router) route(m *pubsub.Message) string {
+	for _, rule := range r.rules {
+		if v, ok := m.Attributes[rule.key]; ok && v == rule.value {
+			return rule.topic
+		}
+	}
+	return r.fallback
+}
+
+// Publish publishes msgs to their routed topics, logging any error, and
+// returns the number of messages published.
+func (r *router) Publish(ctx context.Context, msgs []*pubsub.Message) int {
+	batches := map[string][]*pubsub.Message{}
+	for _, m := range msgs {
+		name := r.route(m)
+		batches[name] = append(batches[name], m)
+	}
+
+	published := 0
+	for name, batch := range batches {
+		n := publishTo(ctx, r.topics[name], batch)
+		r.counts[name] += n
+		published += n
+	}
+	return published
+}
+
+// Report logs the number of messages published to each destination topic.
+func (r *router) Report() {
+	names := make([]string, 0, len(r.topics))
+	for name := range r.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Infof("Routed %d messages to %s", r.counts[name], name)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+var (
+	sampleSize     int
+	sampleDuration time.Duration
+	sampleMaxHeld  int
+)
+
+// samplePreview is how much of each sample message's data is printed.
+const samplePreview = 200
+
+// sampleSizes is how many payload sizes are kept for the percentiles.
+const sampleSizes = 10000
+
+// messageRing keeps the most recent messages added to it, up to its size.
+type messageRing struct {
+	msgs []*pubsub.Message
+	next int
+	full bool
+}
+
+func newMessageRing(size int) *messageRing {
+	return &messageRing{msgs: make([]*pubsub.Message, size)}
+}
+
+// Add stores m, overwriting the oldest message once the ring is full.
+func (r *messageRing) Add(m *pubsub.Message) {
+	r.msgs[r.next] = m
+	r.next = (r.next + 1) % len(r.msgs)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Messages returns the stored messages, oldest first.
+func (r *messageRing) Messages() []*pubsub.Message {
+	if !r.full {
+		return r.msgs[:r.next]
+	}
+	return append(append([]*pubsub.Message{}, r.msgs[r.next:]...), r.msgs[:r.next]...)
+}
+
+// trafficSummary profiles the messages seen by sample. Count, total, min
+// and max are exact; percentiles come from a reservoir sample of sizes.
+type trafficSummary struct {
+	count, total int
+	min, max     int
+	sizes        []int
+	reservoir    int
+	rng          *rand.Rand
+	attrs        map[string]int
+	ring         *messageRing
+}
+
+func newTrafficSummary(size int) *trafficSummary {
+	return &trafficSummary{
+		reservoir: sampleSizes,
+		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		attrs:     make(map[string]int),
+		ring:      newMessageRing(size),
+	}
+}
+
+// Add records m in the summary.
+func (s *trafficSummary) Add(m *pubsub.Message) {
+	n := len(m.Data)
+	if s.count == 0 || n < s.min {
+		s.min = n
+	}
+	if n > s.max {
+		s.max = n
+	}
+	s.count++
+	s.total += n
+	if len(s.sizes) < s.reservoir {
+		s.sizes = append(s.sizes, n)
+	} else if i := s.rng.Intn(s.count); i < s.reservoir {
+		s.sizes[i] = n
+	}
+	for k := range m.Attributes {
+		s.attrs[k]++
+	}
+	s.ring.Add(m)
+}
+
+// percentile returns the pth percentile of sorted.
+func percentile(sorted []int, p float64) int {
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// Print writes the summary to stdout.
+func (s *trafficSummary) Print() {
+	fmt.Printf("messages:       %d\n", s.count)
+	if s.count == 0 {
+		return
+	}
+
+	sizes := append([]int{}, s.sizes...)
+	sort.Ints(sizes)
+	fmt.Printf("payload bytes:\n")
+	fmt.Printf("  min %d, p50 %d, p90 %d, p99 %d, max %d, mean %d\n",
+		s.min, percentile(sizes, 0.5), percentile(sizes, 0.9), percentile(sizes, 0.99),
+		s.max, s.total/s.count)
+
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Printf("attributes:\n")
+	for _, k := range keys {
+		fmt.Printf("  %s: %d (%.0f%%)\n", k, s.attrs[k], 100*float64(s.attrs[k])/float64(s.count))
+	}
+
+	fmt.Printf("samples:\n")
+	for _, m := range s.ring.Messages() {
+		data := m.Data
+		if len(data) > samplePreview {
+			data = data[:samplePreview]
+		}
+		fmt.Printf("  %s %v %q\n", m.ID, m.Attributes, data)
+	}
+}
+
+// sampleTraffic pulls the messages available on the subscription for
+// duration, then releases them all for redelivery so nothing is consumed.
+// Messages are held until the end so repeated pulls don't return the ones
+// already sampled, and sampling stops early once maxHeld are held.
+// Redelivered messages are only counted once.
+func sampleTraffic(gctx context.Context, s *trafficSummary, duration time.Duration, maxHeld int) error {
+	var held []*pubsub.Message
+	defer func() { releaseMessages(gctx, subscription, held) }()
+
+	deadline := time.After(duration)
+	seen := map[string]bool{}
+	for {
+		select {
+		case <-deadline:
+			return nil
+		case <-rootCtx.Done():
+			return nil
+		default:
+		}
+		batch := maxHeld - len(held)
+		if batch <= 0 {
+			log.Warnf("holding --max-held %d messages, stopping early", maxHeld)
+			return nil
+		}
+		if batch > maxPullBatch {
+			batch = maxPullBatch
+		}
+
+		msgs, err := pubsub.Pull(gctx, subscription, batch)
+		if err != nil {
+			return err
+		}
+		held = append(held, msgs...)
+		for _, m := range msgs {
+			if !seen[m.ID] {
+				seen[m.ID] = true
+				s.Add(m)
+			}
+		}
+		if len(msgs) == 0 {
+			// Nothing available; don't spin on empty pulls.
+			select {
+			case <-time.After(time.Second):
+			case <-deadline:
+				return nil
+			case <-rootCtx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// sampleCmd represents the sample command
+var sampleCmd = &cobra.Command{
+	Use:   "sample",
+	Short: "Summarize a subscription's traffic without consuming it",
+	Long: `Pull from --sub for --duration, then release every message pulled so
+it's redelivered, and print the payload size distribution, how often each
+attribute key appears, and the last --size messages seen. Sampling stops
+early once --max-held messages are held. Sampled messages count as
+delivery attempts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if Gceproject == "" || subscription == "" {
+			log.Errorf("GCE project and --sub must be defined")
+			os.Exit(1)
+		}
+		if sampleSize < 1 {
+			log.Errorf("--size must be at least 1")
+			os.Exit(1)
+		}
+		if sampleMaxHeld < 1 {
+			log.Errorf("--max-held must be at least 1")
+			os.Exit(1)
+		}
+
+		// gctx isn't cancelled by signals, so pulled messages are released.
+		gctx := legacyContext()
+		s := newTrafficSummary(sampleSize)
+		err := sampleTraffic(gctx, s, sampleDuration, sampleMaxHeld)
+		s.Print()
+		if err != nil {
+			log.Errorf("error sampling %s: %v", subscription, err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(sampleCmd)
+
+	sampleCmd.Flags().StringVar(&subscription, "sub", "", "PubSub subscription")
+	sampleCmd.Flags().IntVar(&sampleSize, "size", 10, "Number of recent messages kept and printed as samples")
+	sampleCmd.Flags().DurationVar(&sampleDuration, "duration", 10*time.Second, "How long to sample for")
+	sampleCmd.Flags().IntVar(&sampleMaxHeld, "max-held", 10000, "Stop sampling early once this many messages are held for release")
+}
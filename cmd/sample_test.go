@@ -0,0 +1,45 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"google.golang.org/cloud/pubsub"
+)
+
+func TestTrafficSummaryBounded(t *testing.T) {
+	s := newTrafficSummary(3)
+	s.reservoir = 100
+	const n = 10000
+	for i := 1; i <= n; i++ {
+		s.Add(&pubsub.Message{Data: bytes.Repeat([]byte("x"), i%500+1), Attributes: map[string]string{"k": "v"}})
+	}
+	if len(s.sizes) != s.reservoir {
+		t.Errorf("kept %d sizes, want %d", len(s.sizes), s.reservoir)
+	}
+	if s.count != n || s.min != 1 || s.max != 500 || s.attrs["k"] != n {
+		t.Errorf("count %d, min %d, max %d, k seen %d, want %d, 1, 500, %d", s.count, s.min, s.max, s.attrs["k"], n, n)
+	}
+	if got := len(s.ring.Messages()); got != 3 {
+		t.Errorf("ring holds %d messages, want 3", got)
+	}
+	for _, size := range s.sizes {
+		if size < 1 || size > 500 {
+			t.Errorf("reservoir holds size %d, not one seen", size)
+		}
+	}
+}
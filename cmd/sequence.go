@@ -0,0 +1,70 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"google.golang.org/cloud/pubsub"
+)
+
+// sequenceWindow detects duplicate messages by a sequence number attribute
+// stamped by pub --sequence-attr. Sequence numbers within size of the
+// highest seen are tracked exactly; older ones are assumed to be replays.
+type sequenceWindow struct {
+	attr string
+	size int64
+	max  int64
+	seen map[int64]bool
+}
+
+func newSequenceWindow(attr string, size int64) *sequenceWindow {
+	return &sequenceWindow{attr: attr, size: size, seen: make(map[int64]bool)}
+}
+
+// Duplicate reports whether m's sequence number has already been seen.
+// Messages without a valid sequence number are never duplicates.
+func (w *sequenceWindow) Duplicate(m *pubsub.Message) bool {
+	seq, err := strconv.ParseInt(m.Attributes[w.attr], 10, 64)
+	if err != nil {
+		log.Debugf("message %s has no valid %s attribute: %v", m.ID, w.attr, err)
+		return false
+	}
+	if seq <= w.max-w.size || w.seen[seq] {
+		return true
+	}
+	w.seen[seq] = true
+	if seq > w.max {
+		w.max = seq
+	}
+	// Prune lazily so each message isn't a full scan of the window.
+	if int64(len(w.seen)) > 2*w.size {
+		for s := range w.seen {
+			if s <= w.max-w.size {
+				delete(w.seen, s)
+			}
+		}
+	}
+	return false
+}
+
+// Forget removes m's sequence number from the window, so it's no longer a
+// duplicate.
+func (w *sequenceWindow) Forget(m *pubsub.Message) {
+	if seq, err := strconv.ParseInt(m.Attributes[w.attr], 10, 64); err == nil {
+		delete(w.seen, seq)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"google.golang.org/cloud/pubsub"
+)
+
+// signatureAttr holds the hex encoded HMAC of a message's data.
+const signatureAttr = "signature"
+
+var (
+	signKey   string
+	verifyKey string
+	hmacHash  string
+)
+
+// signer computes and checks HMACs of message data with a shared key.
+type signer struct {
+	key  []byte
+	hash func() hash.Hash
+}
+
+// newSigner returns a signer using key and the named hash: sha1, sha256 or
+// sha512.
+func newSigner(key, hashName string) (*signer, error) {
+	if key == "" {
+		return nil, fmt.Errorf("HMAC key must not be empty")
+	}
+	var h func() hash.Hash
+	switch hashName {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha512":
+		h = sha512.New
+	default:
+		return nil, fmt.Errorf("unknown HMAC hash %q: use sha1, sha256 or sha512", hashName)
+	}
+	return &signer{key: []byte(key), hash: h}, nil
+}
+
+// Sign returns the hex encoded HMAC of data.
+func (s *signer) Sign(data []byte) string {
+	mac := hmac.New(s.hash, s.key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks m carries a signature attribute matching the HMAC of its
+// data.
+func (s *signer) Verify(m *pubsub.Message) error {
+	sig, ok := m.Attributes[signatureAttr]
+	if !ok {
+		return fmt.Errorf("message %s has no %s attribute", m.ID, signatureAttr)
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("message %s has a malformed signature: %v", m.ID, err)
+	}
+	mac := hmac.New(s.hash, s.key)
+	mac.Write(m.Data)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fmt.Errorf("message %s signature doesn't match its data", m.ID)
+	}
+	return nil
+}
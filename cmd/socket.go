@@ -0,0 +1,91 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// socketRedialDelay is the pause between attempts to reconnect to the socket.
+const socketRedialDelay = 100 * time.Millisecond
+
+// socketWriter writes to a Unix domain socket, dialling lazily and
+// reconnecting after write errors. Writes are retried on a fresh connection
+// for up to retry from the start of an outage, so a sink which restarts
+// briefly loses nothing; once the outage outlasts retry, each Write makes a
+// single attempt and fails fast until the sink is back.
+type socketWriter struct {
+	path  string
+	retry time.Duration
+	conn  net.Conn
+	// down is when the current outage began, zero while writes succeed.
+	down time.Time
+}
+
+func newSocketWriter(path string, retry time.Duration) *socketWriter {
+	return &socketWriter{path: path, retry: retry}
+}
+
+// Write writes p to the socket, reconnecting as needed. A write which fails
+// part way is resent whole on the next connection.
+func (s *socketWriter) Write(p []byte) (int, error) {
+	for {
+		n, err := s.write(p)
+		if err == nil {
+			s.down = time.Time{}
+			return n, nil
+		}
+		now := time.Now()
+		if s.down.IsZero() {
+			s.down = now
+		}
+		if now.Sub(s.down) >= s.retry {
+			return 0, err
+		}
+		time.Sleep(socketRedialDelay)
+	}
+}
+
+// write makes a single attempt to write p, dialling first if needed.
+func (s *socketWriter) write(p []byte) (int, error) {
+	if s.conn == nil {
+		conn, err := net.Dial("unix", s.path)
+		if err != nil {
+			return 0, err
+		}
+		log.Infof("Connected to %s", s.path)
+		s.conn = conn
+	}
+	n, err := s.conn.Write(p)
+	if err != nil {
+		log.Warnf("error writing to %s, reconnecting: %v", s.path, err)
+		s.conn.Close()
+		s.conn = nil
+	}
+	return n, err
+}
+
+// Close closes the current connection, if any.
+func (s *socketWriter) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,83 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSocketWriterOutage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pubbing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sink")
+
+	retry := 300 * time.Millisecond
+	s := newSocketWriter(path, retry)
+	defer s.Close()
+
+	// The first write of an outage retries for the budget...
+	start := time.Now()
+	if _, err := s.Write([]byte("a")); err == nil {
+		t.Fatal("Write with no sink succeeded")
+	}
+	if d := time.Since(start); d < retry {
+		t.Errorf("first Write returned after %v, want at least %v", d, retry)
+	}
+	// ...and later ones fail fast.
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := s.Write([]byte("b")); err == nil {
+			t.Fatal("Write with no sink succeeded")
+		}
+	}
+	if d := time.Since(start); d >= retry {
+		t.Errorf("10 Writes in an outage took %v, want under %v", d, retry)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 1)
+		c.Read(buf)
+		got <- string(buf)
+	}()
+	if _, err := s.Write([]byte("c")); err != nil {
+		t.Fatalf("Write once the sink is back: %v", err)
+	}
+	if g := <-got; g != "c" {
+		t.Errorf("sink read %q, want %q", g, "c")
+	}
+	if !s.down.IsZero() {
+		t.Error("outage not cleared after a successful Write")
+	}
+}
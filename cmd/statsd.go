@@ -0,0 +1,183 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+var (
+	statsdAddr   string
+	statsdPrefix string
+	statsdFlush  time.Duration
+
+	// stats receives the metrics of pub and sub; nil when --statsd-addr is
+	// unset.
+	stats *statsdClient
+)
+
+// statsdPacketSize keeps each UDP packet under a typical 1500 byte MTU.
+const statsdPacketSize = 1432
+
+// statsdClient aggregates counters and timers in memory and sends them to a
+// StatsD server over UDP every flush interval. Send errors, such as an
+// unreachable server, are logged once and the metrics dropped. A nil client
+// ignores every call.
+type statsdClient struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	prefix   string
+	counters map[string]int64
+	timers   map[string][]time.Duration
+	warned   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newStatsdClient returns a client sending to addr, flushing every interval.
+// Metrics are optional, so if addr can't be resolved it logs a warning and
+// returns the nil, no-op, client.
+func newStatsdClient(addr, prefix string, interval time.Duration) *statsdClient {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Warnf("not sending metrics to statsd %s: %v", addr, err)
+		return nil
+	}
+	if prefix != "" && prefix[len(prefix)-1] != '.' {
+		prefix += "."
+	}
+	s := &statsdClient{
+		conn:     conn,
+		prefix:   prefix,
+		counters: make(map[string]int64),
+		timers:   make(map[string][]time.Duration),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
+
+// setupStatsd points stats at --statsd-addr when it's set.
+func setupStatsd() error {
+	if statsdAddr == "" {
+		return nil
+	}
+	if statsdFlush <= 0 {
+		return fmt.Errorf("--statsd-flush must be positive")
+	}
+	stats = newStatsdClient(statsdAddr, statsdPrefix, statsdFlush)
+	return nil
+}
+
+// Incr adds n to the counter name.
+func (s *statsdClient) Incr(name string, n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.counters[name] += n
+	s.mu.Unlock()
+}
+
+// Timing records one sample of the timer name.
+func (s *statsdClient) Timing(name string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.timers[name] = append(s.timers[name], d)
+	s.mu.Unlock()
+}
+
+func (s *statsdClient) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush sends the metrics gathered since the last flush, packing as many
+// lines into each packet as fit.
+func (s *statsdClient) flush() {
+	s.mu.Lock()
+	var lines []string
+	for name, n := range s.counters {
+		lines = append(lines, fmt.Sprintf("%s%s:%d|c", s.prefix, name, n))
+	}
+	for name, ds := range s.timers {
+		for _, d := range ds {
+			lines = append(lines, fmt.Sprintf("%s%s:%d|ms", s.prefix, name, d/time.Millisecond))
+		}
+	}
+	s.counters = make(map[string]int64)
+	s.timers = make(map[string][]time.Duration)
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(l) > statsdPacketSize {
+			s.send(buf.Bytes())
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(l)
+	}
+	if buf.Len() > 0 {
+		s.send(buf.Bytes())
+	}
+}
+
+func (s *statsdClient) send(p []byte) {
+	if _, err := s.conn.Write(p); err != nil && !s.warned {
+		log.Warnf("error sending metrics to statsd, dropping them: %v", err)
+		s.warned = true
+	}
+}
+
+// Close sends any remaining metrics and closes the connection.
+func (s *statsdClient) Close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.conn.Close()
+}
+
+// statsdFlags adds the StatsD flags to fs.
+func statsdFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&statsdAddr, "statsd-addr", "", "Send counters and timers to the StatsD server at this host:port over UDP")
+	fs.StringVar(&statsdPrefix, "statsd-prefix", "pubbing", "Prefix of the metric names sent to --statsd-addr")
+	fs.DurationVar(&statsdFlush, "statsd-flush", 10*time.Second, "Interval between sends to --statsd-addr")
+}
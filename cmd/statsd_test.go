@@ -0,0 +1,58 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdClient(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := newStatsdClient(conn.LocalAddr().String(), "pubbing", time.Hour)
+	if s == nil {
+		t.Fatal("newStatsdClient returned the no-op client for a listening server")
+	}
+	s.Incr("messages", 2)
+	s.Incr("messages", 1)
+	s.Close()
+
+	buf := make([]byte, statsdPacketSize)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "pubbing.messages:3|c"; got != want {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestStatsdClientUnresolvable(t *testing.T) {
+	s := newStatsdClient("no-port", "pubbing", time.Hour)
+	if s != nil {
+		t.Fatal("newStatsdClient returned a client for an invalid address")
+	}
+	// The no-op client ignores every call.
+	s.Incr("messages", 1)
+	s.Timing("publish.latency", time.Second)
+	s.Close()
+}
@@ -0,0 +1,89 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import "golang.org/x/net/context"
+
+// stopReason records why sub stopped consuming, for the final summary.
+type stopReason int
+
+const (
+	stopCount              stopReason = iota // --num messages consumed
+	stopDeadline                             // --deadline elapsed
+	stopSignal                               // interrupted by a signal
+	stopIdle                                 // --exit-on-idle after --pull-timeout
+	stopMinRate                              // --fail-below-rate tripped
+	stopFinished                             // the iterator finished
+	stopReconnectExhausted                   // --reconnect-max reconnections failed
+)
+
+func (r stopReason) String() string {
+	switch r {
+	case stopCount:
+		return "count"
+	case stopDeadline:
+		return "deadline"
+	case stopSignal:
+		return "signal"
+	case stopIdle:
+		return "idle"
+	case stopMinRate:
+		return "min-rate"
+	case stopFinished:
+		return "finished"
+	case stopReconnectExhausted:
+		return "reconnect-exhausted"
+	}
+	return "unknown"
+}
+
+// ctxStopReason returns why ctx, derived from rootCtx, was cancelled.
+func ctxStopReason(ctx context.Context) stopReason {
+	if ctx.Err() == context.DeadlineExceeded {
+		return stopDeadline
+	}
+	return stopSignal
+}
+
+// subState is what the sub loop has seen that bears on stopping.
+type subState struct {
+	consumed  int  // messages processed
+	belowRate bool // the last heartbeat's throughput was below --min-rate
+	idle      bool // --pull-timeout elapsed without a message
+	finished  bool // the iterator finished
+	gaveUp    bool // --reconnect-max reconnections failed
+	// ctx is cancelled by a signal or --deadline.
+	ctx context.Context
+}
+
+// shouldStop returns whether sub should stop in state s, and if so its exit
+// code and why.
+func shouldStop(s subState) (bool, int, stopReason) {
+	switch {
+	case s.ctx.Err() != nil:
+		return true, 0, ctxStopReason(s.ctx)
+	case s.gaveUp:
+		return true, 1, stopReconnectExhausted
+	case s.finished:
+		return true, 0, stopFinished
+	case s.idle && exitOnIdle:
+		return true, idleExitCode, stopIdle
+	case s.belowRate && failBelowRate:
+		return true, 1, stopMinRate
+	case s.consumed >= numConsume:
+		return true, 0, stopCount
+	}
+	return false, 0, stopCount
+}
@@ -0,0 +1,106 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestStopReasonString(t *testing.T) {
+	tests := []struct {
+		r    stopReason
+		want string
+	}{
+		{stopCount, "count"},
+		{stopDeadline, "deadline"},
+		{stopSignal, "signal"},
+		{stopIdle, "idle"},
+		{stopMinRate, "min-rate"},
+		{stopFinished, "finished"},
+		{stopReconnectExhausted, "reconnect-exhausted"},
+		{stopReason(-1), "unknown"},
+	}
+	for _, tt := range tests {
+		if got := tt.r.String(); got != tt.want {
+			t.Errorf("stopReason(%d).String() = %q, want %q", int(tt.r), got, tt.want)
+		}
+	}
+}
+
+func TestCtxStopReason(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-expired.Done()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want stopReason
+	}{
+		{"deadline", expired, stopDeadline},
+		{"signal", cancelled, stopSignal},
+	}
+	for _, tt := range tests {
+		if got := ctxStopReason(tt.ctx); got != tt.want {
+			t.Errorf("%s: ctxStopReason = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShouldStop(t *testing.T) {
+	defer func(n int, onIdle bool, idleCode int, failRate bool) {
+		numConsume, exitOnIdle, idleExitCode, failBelowRate = n, onIdle, idleCode, failRate
+	}(numConsume, exitOnIdle, idleExitCode, failBelowRate)
+	numConsume, idleExitCode = 10, 3
+
+	bg := context.Background()
+	expired, cancel := context.WithTimeout(bg, time.Nanosecond)
+	defer cancel()
+	<-expired.Done()
+	cancelled, cancel := context.WithCancel(bg)
+	cancel()
+
+	tests := []struct {
+		name             string
+		s                subState
+		onIdle, failRate bool
+		stop             bool
+		code             int
+		reason           stopReason
+	}{
+		{"running", subState{ctx: bg, consumed: 9}, false, false, false, 0, stopCount},
+		{"count", subState{ctx: bg, consumed: 10}, false, false, true, 0, stopCount},
+		{"idle", subState{ctx: bg, idle: true}, true, false, true, 3, stopIdle},
+		{"idle without --exit-on-idle", subState{ctx: bg, idle: true}, false, false, false, 0, stopCount},
+		{"min-rate", subState{ctx: bg, belowRate: true}, false, true, true, 1, stopMinRate},
+		{"below rate without --fail-below-rate", subState{ctx: bg, belowRate: true}, false, false, false, 0, stopCount},
+		{"finished", subState{ctx: bg, finished: true}, false, false, true, 0, stopFinished},
+		{"reconnect-exhausted", subState{ctx: bg, gaveUp: true, consumed: 10}, false, false, true, 1, stopReconnectExhausted},
+		{"deadline", subState{ctx: expired, gaveUp: true}, false, false, true, 0, stopDeadline},
+		{"signal", subState{ctx: cancelled, idle: true}, true, false, true, 0, stopSignal},
+	}
+	for _, tt := range tests {
+		exitOnIdle, failBelowRate = tt.onIdle, tt.failRate
+		stop, code, reason := shouldStop(tt.s)
+		if stop != tt.stop || code != tt.code || reason != tt.reason {
+			t.Errorf("%s: shouldStop = %v, %d, %v, want %v, %d, %v", tt.name, stop, code, reason, tt.stop, tt.code, tt.reason)
+		}
+	}
+}
@@ -15,16 +15,23 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"os"
-	"os/signal"
+	"sort"
+	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/pubsub"
@@ -33,41 +40,513 @@ import (
 var (
 	subscription string
 	numConsume   int
-	quit         chan os.Signal
 	ack          bool
+	ackFirst     bool
+	ackBatchSize int
+	ackBatchWait time.Duration
+	logAcks      bool
+
+	probe        bool
+	probeTimeout time.Duration
+	noWait       bool
+	peek         bool
+
+	subAutocreate  bool
+	subAckDeadline time.Duration
+
+	startupJitter time.Duration
+	pullTimeout   time.Duration
+	exitOnIdle    bool
+	idleExitCode  int
+	heartbeat     time.Duration
+	noHeartbeat   bool
+	reconnectMax  int
+	minRate       float64
+	failBelowRate bool
+
+	subSequenceAttr    string
+	sequenceWindowSize int64
+
+	outputFormat   string
+	csvAttrs       []string
+	attributesOnly bool
+	redactAttrs    []string
+	printAttrKeys  bool
+	outFile        string
+	gzipOut        bool
+	sampleRate     float64
+	sampleSeed     int64
+	expectMin      int
+	countOutput    bool
+	dropExpired    bool
+	outSocket      string
+	outSocketRetry time.Duration
+	outSocketNack  bool
+	flushInterval  time.Duration
+	reassemble     bool
+
+	decodeMode         string
+	decodeEncodingAttr string
+	decodeTypeAttr     string
 )
 
-// shouldQuit listens on the quit channel and returns true
-// if the signal has been caught and closes the channel.
-func shouldQuit(quit chan os.Signal) bool {
-	select {
-	case q := <-quit:
-		log.Warnf("quit signal sent: %v", q)
-		signal.Stop(quit)
-		quit = nil
+// messageExpired reports whether m carries an expires-at attribute, as set
+// by pub --ttl, which is before now. Unparseable times are not expired.
+func messageExpired(m *pubsub.Message, now time.Time) bool {
+	v, ok := m.Attributes[expiresAtAttr]
+	if !ok {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Debugf("message %s has invalid %s %q: %v", m.ID, expiresAtAttr, v, err)
+		return false
+	}
+	return t.Before(now)
+}
+
+// checkExpectMin reports n consumed messages against --expect-min and
+// returns false if fewer than expected were consumed.
+func checkExpectMin(n int) bool {
+	if expectMin <= 0 {
 		return true
-	default:
-		//log.Debugf("shouldQuit defaulting")
+	}
+	if n < expectMin {
+		log.Errorf("Consumed %d messages, expected at least %d", n, expectMin)
 		return false
 	}
+	log.Infof("Consumed %d messages, expected at least %d", n, expectMin)
+	return true
 }
 
-// JWTClientInit reads in a service account JSON token and creates an oauth
-// token for communicating with GCE.
-func JWTClientInit(ctx *context.Context) *pubsub.Client {
+// ackBatcher collects consumed messages and acknowledges their AckIDs with a
+// single Acknowledge call per batch. The iterator buffers Done(true) acks
+// and sends them on a ticker, so the batcher doesn't save calls; it bounds
+// how many messages and how long acks are outstanding. It is safe for
+// concurrent use, so the reconnecting iterator can flush it.
+type ackBatcher struct {
+	// gctx is a cloud context used by the legacy pubsub.Ack call.
+	gctx context.Context
+	sub  string
+	size int
+
+	mu   sync.Mutex
+	msgs []*pubsub.Message
+}
+
+// Add queues m to be acked, flushing once the batch is full.
+func (b *ackBatcher) Add(m *pubsub.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.msgs = append(b.msgs, m)
+	if len(b.msgs) >= b.size {
+		b.flush()
+	}
+}
+
+// Flush acknowledges all queued messages. The messages are then released
+// from the iterator with Done(false), which stops their deadline extension
+// without nacking them.
+func (b *ackBatcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flush()
+}
+
+func (b *ackBatcher) flush() {
+	if len(b.msgs) == 0 {
+		return
+	}
+	ids := make([]string, len(b.msgs))
+	for i, m := range b.msgs {
+		ids[i] = m.AckID
+	}
+	if err := pubsub.Ack(b.gctx, b.sub, ids...); err != nil {
+		log.Errorf("error acking %d messages: %v", len(ids), err)
+	}
+	for _, m := range b.msgs {
+		m.Done(false)
+	}
+	b.msgs = b.msgs[:0]
+}
+
+// ensureSubscription creates the subscription to the topic with
+// --ack-deadline if it doesn't exist, logging the configuration it was
+// created with. An existing subscription is left as it is.
+func ensureSubscription(ctx context.Context, client *pubsub.Client) error {
+	ok, err := client.Subscription(subscription).Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if ok {
+		log.Debugf("Subscription %s exists, not creating it", subscription)
+		return nil
+	}
+	if _, err := client.NewSubscription(ctx, subscription, client.Topic(Topic), subAckDeadline, nil); err != nil {
+		return err
+	}
+	d, err := describeSubscription(ctx, client, subscription)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"topic":       d.Topic,
+		"ackDeadline": d.AckDeadline,
+	}).Infof("Created subscription %s", d.Name)
+	return nil
+}
+
+// probeSubscription makes a single non-blocking pull from the subscription,
+// returning an error if it can't be read within timeout. A pulled message
+// has its ack deadline reset so it's redelivered straight away.
+func probeSubscription(timeout time.Duration) error {
+	gctx := legacyContext()
+	result := make(chan error, 1)
+	go func() {
+		msgs, err := pubsub.Pull(gctx, subscription, 1)
+		for _, m := range msgs {
+			if err := pubsub.ModifyAckDeadline(gctx, subscription, m.AckID, 0); err != nil {
+				log.Warnf("error releasing probed message %s: %v", m.ID, err)
+			}
+		}
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no response within %v", timeout)
+	}
+}
+
+// maxPullBatch is the most messages a single legacy Pull may return.
+const maxPullBatch = 100
+
+// pullNoWait pulls up to n of the messages currently available from the
+// subscription without waiting for more, writing those filter accepts to
+// out and acking them after when --ack is set, or before with --ack-first.
+// Expired messages are always acked and unverified ones never are. It
+// returns the number of messages consumed.
+func pullNoWait(n int, out messageWriter, filter *messageFilter) (int, error) {
+	gctx := legacyContext()
+	pulled, consumed := 0, 0
+	for pulled < n && rootCtx.Err() == nil {
+		batch := n - pulled
+		if batch > maxPullBatch {
+			batch = maxPullBatch
+		}
+		msgs, err := pubsub.Pull(gctx, subscription, batch)
+		if err != nil {
+			return consumed, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		pulled += len(msgs)
+
+		var drop, ids []string
+		var keep []*pubsub.Message
+		now := time.Now()
+		for _, m := range msgs {
+			switch filter.Check(m, now) {
+			case expired:
+				drop = append(drop, m.AckID)
+			case unverified:
+			case duplicate:
+				ids = append(ids, m.AckID)
+			default:
+				ids = append(ids, m.AckID)
+				keep = append(keep, m)
+			}
+		}
+		if len(drop) > 0 {
+			if err := pubsub.Ack(gctx, subscription, drop...); err != nil {
+				log.Errorf("error acking %d expired messages: %v", len(drop), err)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if ackFirst {
+			if err := pubsub.Ack(gctx, subscription, ids...); err != nil {
+				return consumed, fmt.Errorf("error acking %d messages before processing: %v", len(ids), err)
+			}
+		}
+		for _, m := range keep {
+			if out != nil {
+				if err := out.Write(m); err != nil {
+					log.Errorf("error writing message %s: %v", m.ID, err)
+				}
+			}
+		}
+		if ack {
+			if err := pubsub.Ack(gctx, subscription, ids...); err != nil {
+				log.Errorf("error acking %d messages: %v", len(ids), err)
+			}
+		}
+		consumed += len(keep)
+	}
+	return consumed, nil
+}
+
+// peekMessages pulls up to n of the messages currently available from the
+// subscription, writes those filter accepts to out, then releases them all
+// for redelivery by setting their ack deadline to 0. Messages are held until
+// the end so repeated pulls don't return the ones already peeked. It returns
+// the number of messages peeked.
+func peekMessages(n int, out messageWriter, filter *messageFilter) (int, error) {
+	// gctx isn't cancelled by signals, so the release below always runs.
+	gctx := legacyContext()
+	var held []*pubsub.Message
+	seen := map[string]bool{}
+	peeked := 0
+	var err error
+	for len(held) < n && rootCtx.Err() == nil {
+		batch := n - len(held)
+		if batch > maxPullBatch {
+			batch = maxPullBatch
+		}
+		var msgs []*pubsub.Message
+		if msgs, err = pubsub.Pull(gctx, subscription, batch); err != nil || len(msgs) == 0 {
+			break
+		}
+		for _, m := range msgs {
+			if seen[m.ID] {
+				continue
+			}
+			seen[m.ID] = true
+			held = append(held, m)
+			if filter.Check(m, time.Now()) != accepted {
+				continue
+			}
+			peeked++
+			if err := out.Write(m); err != nil {
+				log.Errorf("error writing message %s: %v", m.ID, err)
+			}
+		}
+	}
+
+	releaseMessages(gctx, subscription, held)
+	return peeked, err
+}
+
+// readMessages sends the messages read from it on msgs until it reports
+// Done or stopping is closed, and returns nil. Errors are logged and reading
+// continues, unless giveUp is set because it reconnects itself, when the
+// error is returned.
+func readMessages(it messageIterator, msgs chan<- *pubsub.Message, stopping <-chan struct{}, giveUp bool) error {
+	for {
+		m, err := it.Next()
+		if err == pubsub.Done {
+			log.Infof("pubsub iterator finished")
+			return nil
+		}
+		if err != nil {
+			if giveUp {
+				return err
+			}
+			log.Errorf("error reading from iterator: %v", err)
+			select {
+			case <-stopping:
+				return nil
+			default:
+				continue
+			}
+		}
+		select {
+		case msgs <- m:
+		case <-stopping:
+			m.Done(false)
+			return nil
+		}
+	}
+}
+
+// processMessage runs process on m, or skips it when process is nil. With
+// --ack-first, ack is set and m is acked first for at-most-once delivery: a
+// message whose ack fails is left for redelivery unprocessed, and the ack
+// error returned. It reports whether m was written.
+func processMessage(m *pubsub.Message, ack func(ackID string) error, process func(*pubsub.Message) bool) (bool, error) {
+	if ack != nil {
+		if err := ack(m.AckID); err != nil {
+			return false, err
+		}
+	}
+	if process == nil {
+		return true, nil
+	}
+	return process(m), nil
+}
+
+// printAttributeKeys reports how many messages carried each attribute key,
+// sorted by key, as JSON on stdout for --output=json or as log lines.
+func printAttributeKeys(counts map[string]int) {
+	if outputFormat == "json" {
+		printJSON(counts)
+		return
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	log.Infof("Observed %d attribute keys", len(keys))
+	for _, k := range keys {
+		log.Infof("attribute %s: %d", k, counts[k])
+	}
+}
+
+// logAckedIDs logs ids as a single line, throttling --log-acks output to
+// one line per heartbeat, and returns ids emptied for reuse.
+func logAckedIDs(ids []string) []string {
+	if len(ids) > 0 {
+		log.Infof("Acked %d messages: %s", len(ids), strings.Join(ids, ","))
+	}
+	return ids[:0]
+}
+
+// serviceAccountKey holds the fields of a service account JSON key which are
+// checked before the key is handed to the oauth2 library.
+type serviceAccountKey struct {
+	Type        string `json:"type"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	ProjectID   string `json:"project_id"`
+}
+
+// errInvalidKey is returned by checkServiceAccountKey for keys which aren't
+// service account JSON.
+var errInvalidKey = errors.New("keyfile is not a valid service account JSON")
+
+// checkServiceAccountKey returns errInvalidKey if jsonKey doesn't parse as a
+// service account key, a common first-time setup mistake which otherwise
+// produces an obscure error from the oauth2 library.
+func checkServiceAccountKey(jsonKey []byte) error {
+	var k serviceAccountKey
+	if err := json.Unmarshal(jsonKey, &k); err != nil {
+		return errInvalidKey
+	}
+	if k.Type != "service_account" || k.ClientEmail == "" || k.PrivateKey == "" {
+		return errInvalidKey
+	}
+	return nil
+}
+
+// inferProject defaults Gceproject to the project_id of the service account
+// key when --project isn't given. Unreadable keys are left for
+// JWTClientInit to report.
+func inferProject() {
+	if Gceproject != "" || KeyPath == "" {
+		return
+	}
+	jsonKey, err := ioutil.ReadFile(KeyPath)
+	if err != nil {
+		return
+	}
+	var k serviceAccountKey
+	if err := json.Unmarshal(jsonKey, &k); err != nil || k.ProjectID == "" {
+		return
+	}
+	Gceproject = k.ProjectID
+	log.Infof("Using project %s from keyfile %s", Gceproject, KeyPath)
+}
+
+// baseTransport returns the transport for API requests: one keeping up to
+// ConnPool idle connections when ConnPool is set, and presenting ClientCert
+// to TLS servers when that is set, or nil for the library's default.
+func baseTransport() (*http.Transport, error) {
+	if ConnPool <= 0 && ClientCert == "" && ClientKey == "" {
+		return nil, nil
+	}
+	base := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost: ConnPool,
+	}
+	if ClientCert != "" || ClientKey != "" {
+		if ClientCert == "" || ClientKey == "" {
+			return nil, errors.New("--client-cert and --client-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(ClientCert, ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate %s and key %s: %v", ClientCert, ClientKey, err)
+		}
+		base.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return base, nil
+}
+
+// newPubSubClient creates a pubsub.Client authenticated by ts, using
+// baseTransport when it isn't the default.
+func newPubSubClient(ctx context.Context, project string, ts oauth2.TokenSource) (*pubsub.Client, error) {
+	opts := []cloud.ClientOption{cloud.WithTokenSource(ts)}
+	base, err := baseTransport()
+	if err != nil {
+		return nil, err
+	}
+	if base != nil {
+		opts = append(opts, cloud.WithBaseHTTP(&http.Client{
+			Transport: &oauth2.Transport{Source: ts, Base: base},
+		}))
+	}
+	return pubsub.NewClient(ctx, project, opts...)
+}
+
+// keyTokenSource reads in a service account JSON key and returns a token
+// source for it.
+func keyTokenSource(ctx context.Context) oauth2.TokenSource {
 	jsonKey, err := ioutil.ReadFile(KeyPath)
 	if err != nil {
 		log.Errorf("error reading keyfile: %v", err)
 		os.Exit(1)
 	}
+	if err := checkServiceAccountKey(jsonKey); err != nil {
+		log.Errorf("%v: %s", err, KeyPath)
+		os.Exit(1)
+	}
 
 	conf, err := google.JWTConfigFromJSON(jsonKey, pubsub.ScopePubSub)
 	if err != nil {
 		log.Errorf("error creating conf file: %v", err)
+		os.Exit(1)
 	}
+	if TokenEarly > 0 {
+		return newEarlyRefreshSource(TokenEarly, func() (oauth2.TokenSource, error) {
+			return conf.TokenSource(ctx), nil
+		})
+	}
+	return conf.TokenSource(ctx)
+}
+
+// defaultTokenSource uses Google's host FS searching functionality to find
+// auth tokens if they exist. eg: GCE VMs, Authenticated Developers
+func defaultTokenSource(ctx context.Context) oauth2.TokenSource {
+	source, err := google.DefaultTokenSource(ctx, pubsub.ScopePubSub)
+	if err != nil {
+		log.Errorf("error creating token source: %v", err)
+		os.Exit(1)
+	}
+	if TokenEarly > 0 {
+		return newEarlyRefreshSource(TokenEarly, func() (oauth2.TokenSource, error) {
+			return google.DefaultTokenSource(ctx, pubsub.ScopePubSub)
+		})
+	}
+	return source
+}
+
+// tokenSourceInit returns the token source of the service account key when
+// one is given, or of the host's default credentials otherwise.
+func tokenSourceInit(ctx context.Context) oauth2.TokenSource {
+	if KeyPath != "" {
+		return keyTokenSource(ctx)
+	}
+	return defaultTokenSource(ctx)
+}
 
-	oauthTokenSource := conf.TokenSource(*ctx)
-	psClient, err := pubsub.NewClient(*ctx, Gceproject, cloud.WithTokenSource(oauthTokenSource))
+// JWTClientInit reads in a service account JSON token and creates an oauth
+// token for communicating with GCE.
+func JWTClientInit(ctx *context.Context) *pubsub.Client {
+	psClient, err := newPubSubClient(*ctx, Gceproject, keyTokenSource(*ctx))
 	if err != nil {
 		log.Errorf("error creating pubsub client: %v", err)
 		os.Exit(1)
@@ -75,26 +554,57 @@ func JWTClientInit(ctx *context.Context) *pubsub.Client {
 	return psClient
 }
 
-// GCEClientInit uses Google's host FS searching functionality to find auth
-// tokens if they exist. eg: GCE VMs, Authenticated Developers
+// GCEClientInit creates a client authenticated with the host's default
+// credentials.
 func GCEClientInit(ctx *context.Context, project string) *pubsub.Client {
-	var client *pubsub.Client
-	clientOnce := new(sync.Once)
-	clientOnce.Do(func() {
-		source, err := google.DefaultTokenSource(*ctx, pubsub.ScopePubSub)
-		if err != nil {
-			log.Errorf("error creating token source: %v", err)
-			os.Exit(1)
-		}
-		client, err = pubsub.NewClient(*ctx, project, cloud.WithTokenSource(source))
-		if err != nil {
-			log.Errorf("error creating pubsub.Client: %v", err)
-			os.Exit(1)
-		}
-	})
+	client, err := newPubSubClient(*ctx, project, defaultTokenSource(*ctx))
+	if err != nil {
+		log.Errorf("error creating pubsub.Client: %v", err)
+		os.Exit(1)
+	}
 	return client
 }
 
+// clientInit returns a pubsub.Client authenticated with the service account
+// key when one is given, or with the host's default credentials otherwise.
+func clientInit(ctx *context.Context) *pubsub.Client {
+	var psClient *pubsub.Client
+	if KeyPath != "" {
+		psClient = JWTClientInit(ctx)
+	} else {
+		psClient = GCEClientInit(ctx, Gceproject)
+	}
+	if psClient == nil {
+		log.Errorf("PubSub client is nil")
+		os.Exit(1)
+	}
+	return psClient
+}
+
+// httpClientInit returns an HTTP client for the raw and legacy APIs with
+// the same credentials and transport as clientInit, so every call made
+// for a command acts as the same identity.
+func httpClientInit() *http.Client {
+	base, err := baseTransport()
+	if err != nil {
+		log.Errorf("error creating http client: %v", err)
+		os.Exit(1)
+	}
+	var rt http.RoundTripper = http.DefaultTransport
+	if base != nil {
+		rt = base
+	}
+	ts := tokenSourceInit(context.Background())
+	return &http.Client{Transport: &oauth2.Transport{Source: ts, Base: rt}}
+}
+
+// legacyContext returns a cloud context for the legacy pubsub calls, such
+// as Pull and Ack, authenticated like clientInit. It isn't cancelled by
+// signals, so cleanup calls made with it still run on shutdown.
+func legacyContext() context.Context {
+	return cloud.NewContext(Gceproject, httpClientInit())
+}
+
 // subCmd represents the sub command
 var subCmd = &cobra.Command{
 	Use:   "sub",
@@ -104,16 +614,64 @@ var subCmd = &cobra.Command{
 		log.Debugf("sub called on topic: %s", Topic)
 		logsetup()
 
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
 		if Gceproject == "" || Topic == "" || subscription == "" {
 			log.Errorf("GCE project, subscription, and topic must be defined")
 			os.Exit(1)
 		}
+		if exitOnIdle && pullTimeout <= 0 {
+			log.Errorf("--exit-on-idle needs --pull-timeout to set the idle period")
+			os.Exit(1)
+		}
+		if subAutocreate && (subAckDeadline < 10*time.Second || subAckDeadline > 10*time.Minute) {
+			log.Errorf("--ack-deadline must be between 10s and 10m")
+			os.Exit(1)
+		}
+		if reconnectBase <= 0 || reconnectMaxDelay < reconnectBase {
+			log.Errorf("--reconnect-base must be positive and no more than --reconnect-max-delay")
+			os.Exit(1)
+		}
+		var verifier *signer
+		if verifyKey != "" {
+			var err error
+			if verifier, err = newSigner(verifyKey, hmacHash); err != nil {
+				log.Errorf("%v", err)
+				os.Exit(1)
+			}
+		}
+		filter := newMessageFilter(verifier)
+		if sampleRate < 0 || sampleRate > 1 {
+			log.Errorf("--sample-rate must be between 0.0 and 1.0")
+			os.Exit(1)
+		}
+		if ackBatchSize > 0 && ackBatchWait <= 0 {
+			log.Errorf("--ack-batch-wait must be positive")
+			os.Exit(1)
+		}
+		if noWait && (printAttrKeys || sampleRate < 1 || reassemble || logAcks) {
+			log.Errorf("--no-wait can't be used with --print-attributes-keys, --sample-rate, --reassemble or --log-acks")
+			os.Exit(1)
+		}
+		if noHeartbeat && minRate > 0 {
+			log.Errorf("--min-rate needs heartbeat throughput and can't be used with --no-heartbeat")
+			os.Exit(1)
+		}
+
+		if err := setupStatsd(); err != nil {
+			log.Errorf("error setting up statsd: %v", err)
+			os.Exit(1)
+		}
+
+		if probe {
+			if err := probeSubscription(probeTimeout); err != nil {
+				log.Errorf("subscription %s unreachable: %v", subscription, err)
+				os.Exit(1)
+			}
+			log.Infof("subscription %s reachable", subscription)
+			os.Exit(0)
+		}
 
 		// Configure connection to pubsub
-		ctx := context.Background()
+		ctx := rootCtx
 		var psClient *pubsub.Client
 		if KeyPath != "" {
 			psClient = JWTClientInit(&ctx)
@@ -126,67 +684,475 @@ var subCmd = &cobra.Command{
 		}
 		log.Debugf("client: %#v", psClient)
 
+		var out messageWriter
+		var stream *outputStream
+		closeOut := func() {}
+		if peek && (ack || ackFirst) {
+			log.Errorf("--peek never acks and can't be used with --ack or --ack-first")
+			os.Exit(1)
+		}
+		if ackFirst && ack {
+			log.Errorf("--ack-first acks every message itself and can't be used with --ack")
+			os.Exit(1)
+		}
+		if outSocketNack && outSocket == "" {
+			log.Errorf("--out-socket-nack needs --out-socket")
+			os.Exit(1)
+		}
+		if ackFirst && outSocketNack {
+			log.Errorf("--ack-first acks before writing, so --out-socket-nack can't leave messages for redelivery")
+			os.Exit(1)
+		}
+		if (attributesOnly || outSocket != "" || peek || decodeMode != "") && outputFormat == "" {
+			outputFormat = "json"
+		}
+		if outSocket != "" && outFile != "" {
+			log.Errorf("--out-socket and --out-file can't be used together")
+			os.Exit(1)
+		}
+		if countOutput {
+			if outputFormat != "" && outFile == "" && outSocket == "" {
+				log.Errorf("--count-output keeps stdout for the count; write --output to --out-file or --out-socket")
+				os.Exit(1)
+			}
+			if printAttrKeys && outputFormat == "json" {
+				log.Errorf("--count-output can't be used with --print-attributes-keys and --output=json")
+				os.Exit(1)
+			}
+			if LogFile == "" {
+				log.SetOutput(os.Stderr)
+			}
+		}
+		if outputFormat != "" {
+			// Keep logs out of the messages written to stdout.
+			if LogFile == "" && outFile == "" && outSocket == "" {
+				log.SetOutput(os.Stderr)
+			}
+			var err error
+			if stream, err = openOutput(outFile, outSocket, gzipOut, flushInterval > 0); err != nil {
+				log.Errorf("error opening output: %v", err)
+				os.Exit(1)
+			}
+			if out, err = newMessageWriter(outputFormat, stream); err != nil {
+				log.Errorf("error creating output: %v", err)
+				os.Exit(1)
+			}
+			closeOut = func() {
+				if err := out.Flush(); err != nil {
+					log.Errorf("error flushing output: %v", err)
+				}
+				if err := stream.Close(); err != nil {
+					log.Errorf("error closing output: %v", err)
+				}
+			}
+		} else if outFile != "" || gzipOut || cmd.Flags().Changed("sample-rate") {
+			log.Errorf("--out-file, --gzip-out and --sample-rate require --output")
+			os.Exit(1)
+		}
+
+		if err := waitForTopicReady(ctx, psClient, Topic); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		if subAutocreate {
+			if err := ensureSubscription(ctx, psClient); err != nil {
+				log.Errorf("error creating subscription %s: %v", subscription, err)
+				os.Exit(1)
+			}
+		}
+
+		if peek {
+			log.Warnf("Peeked messages are redelivered to %s and count as delivery attempts", subscription)
+			n, err := peekMessages(numConsume, out, filter)
+			closeOut()
+			if err != nil {
+				log.Errorf("error peeking at %s: %v", subscription, err)
+				os.Exit(1)
+			}
+			log.Infof("Peeked %d messages", n)
+			if countOutput {
+				fmt.Println(n)
+			}
+			os.Exit(0)
+		}
+
+		if noWait {
+			n, err := pullNoWait(numConsume, out, filter)
+			closeOut()
+			stats.Incr("messages", int64(n))
+			if ack || ackFirst {
+				stats.Incr("acks", int64(n))
+			}
+			stats.Close()
+			if err != nil {
+				log.Errorf("error pulling from %s: %v", subscription, err)
+				os.Exit(1)
+			}
+			if n == 0 {
+				log.Infof("No messages available on %s", subscription)
+			}
+			log.Infof("Final Processed %d", n)
+			if countOutput {
+				fmt.Println(n)
+			}
+			if !checkExpectMin(n) {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
+		// Spread out the initial pulls of many consumer replicas.
+		if startupJitter > 0 {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+			delay := time.Duration(rng.Int63n(int64(startupJitter)))
+			log.Infof("Delaying startup by %v", delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				os.Exit(0)
+			}
+		}
+
 		// Create message iterator from client
 		sub := psClient.Subscription(subscription)
-		it, err := sub.Pull(ctx, pubsub.MaxExtension(time.Minute*1))
+		it, err := newReconnectingIterator(sub, reconnectMax)
 		if err != nil {
 			log.Errorf("error creating pubsub iterator: %v", err)
+			os.Exit(1)
 		}
-		defer it.Stop()
 
+		var batcher *ackBatcher
+		switch {
+		case ack && ackBatchSize > 0:
+			batcher = &ackBatcher{
+				gctx: legacyContext(),
+				sub:  subscription,
+				size: ackBatchSize,
+			}
+			// Held messages would block stopping the failed iterator.
+			it.beforeReconnect = batcher.Flush
+		}
+
+		// finished is closed when the iterator reports there is nothing
+		// more to read, and gaveUp, after pullErr is set, when
+		// --reconnect-max reconnections have failed. Otherwise errors are
+		// logged and pulling continues.
 		msgs := make(chan *pubsub.Message)
+		stopping := make(chan struct{})
+		finished := make(chan struct{})
+		gaveUp := make(chan struct{})
+		var pullErr error
 		go func() {
-			for !shouldQuit(quit) {
-				m, err := it.Next()
-				if err != nil {
-					switch err {
-					case pubsub.Done:
-						log.Infof("pubsub interator finished")
-					default:
-						log.Errorf("error reading from iterator: %v", err)
+			if err := readMessages(it, msgs, stopping, reconnectMax > 0); err != nil {
+				pullErr = err
+				close(gaveUp)
+				return
+			}
+			close(finished)
+		}()
+
+		// ackNow sends --ack-first acks synchronously, outside the iterator.
+		var ackNow func(ackID string) error
+		if ackFirst {
+			ackCtx := legacyContext()
+			ackNow = func(ackID string) error {
+				return pubsub.Ack(ackCtx, subscription, ackID)
+			}
+		}
+
+		// idle fires when no message has arrived within pullTimeout.
+		var idle <-chan time.Time
+		var idleTimer *time.Timer
+		if pullTimeout > 0 {
+			idleTimer = time.NewTimer(pullTimeout)
+			idle = idleTimer.C
+		}
+
+		// flushTick writes buffered output through at --flush-interval.
+		var flushTick <-chan time.Time
+		if stream != nil && flushInterval > 0 {
+			ticker := time.NewTicker(flushInterval)
+			defer ticker.Stop()
+			flushTick = ticker.C
+		}
+
+		// batchTick acks partial batches at --ack-batch-wait.
+		var batchTick <-chan time.Time
+		if batcher != nil {
+			ticker := time.NewTicker(ackBatchWait)
+			defer ticker.Stop()
+			batchTick = ticker.C
+		}
+
+		var beat <-chan time.Time
+		if heartbeat > 0 {
+			ticker := time.NewTicker(heartbeat)
+			defer ticker.Stop()
+			beat = ticker.C
+		}
+
+		// sample picks which messages are written to out; every message is
+		// still counted and acked.
+		var sample *rand.Rand
+		if sampleRate < 1 {
+			seed := sampleSeed
+			if seed == 0 {
+				seed = time.Now().UnixNano()
+			}
+			log.Debugf("sampling output at %f with seed %d", sampleRate, seed)
+			sample = rand.New(rand.NewSource(seed))
+		}
+
+		// chunks reassembles payloads split by pub --chunk.
+		var chunks *reassembler
+		if reassemble {
+			chunks = newReassembler()
+			filter.reassembling = true
+		}
+
+		// attrKeys counts the messages carrying each attribute key.
+		var attrKeys map[string]int
+		if printAttrKeys {
+			attrKeys = make(map[string]int)
+		}
+
+		// ackedIDs collects the IDs of acked messages for --log-acks.
+		var ackedIDs []string
+
+		// Skip the bar when messages are written to stdout.
+		var bar *progressBar
+		if !countOutput && (outputFormat == "" || outFile != "" || outSocket != "") {
+			bar = newProgressBar(numConsume)
+		}
+
+		// process counts, reassembles and writes an accepted message,
+		// returning false if it should be left for redelivery.
+		process := func(m *pubsub.Message) bool {
+			if attrKeys != nil {
+				for k := range m.Attributes {
+					attrKeys[k]++
+				}
+			}
+			wm := m
+			if chunks != nil {
+				var err error
+				if wm, err = chunks.Add(m); err != nil {
+					log.Errorf("error reassembling: %v", err)
+				}
+				// Chunks carry the signature of the whole payload.
+				if wm != nil && verifier != nil {
+					if err := verifier.Verify(wm); err != nil {
+						log.Warnf("dropping reassembled payload: %v", err)
+						stats.Incr("verify.failures", 1)
+						wm = nil
 					}
 				}
-				if quit == nil { //exit ASAP after Next() returns
-					break
+			}
+			if wm != nil && out != nil && (sample == nil || sample.Float64() < sampleRate) {
+				if err := out.Write(wm); err != nil {
+					log.Errorf("error writing message %s: %v", m.ID, err)
+					return outSocket == "" || !outSocketNack
 				}
-				msgs <- m
 			}
-		}()
+			return true
+		}
 
 		start := time.Now()
+		lastBeat := start
 		i0 := 0
 		i1 := 0
+		st := subState{ctx: ctx}
+		code := 0
 		for {
 			select {
 			case m := <-msgs:
 				//log.WithFields(log.Fields{"data": m.Data, "str": string(m.Data), "ID": m.ID}).Debugf("msg[%s]", m.ID)
-				i0++
-				if ack {
+				if idleTimer != nil {
+					idleTimer.Reset(pullTimeout)
+				}
+				v := filter.Check(m, time.Now())
+				switch v {
+				case expired:
+					// Expired messages are acked so they aren't redelivered.
 					m.Done(true)
+					continue
+				case unverified:
+					// Nack it: a redelivery may be intact, and it's left for
+					// inspection otherwise.
+					m.Done(false)
+					continue
+				}
+				var proc func(*pubsub.Message) bool
+				if v != duplicate {
+					proc = process
+				}
+				written, err := processMessage(m, ackNow, proc)
+				if err != nil {
+					log.Errorf("error acking message %s, skipping it: %v", m.ID, err)
+					filter.Forget(m)
+					m.Done(false)
+					continue
+				}
+				if !written {
+					// Leave it for redelivery once the sink is back; it
+					// isn't counted as processed.
+					m.Done(false)
+					break
+				}
+				if (ack || ackFirst) && logAcks {
+					ackedIDs = append(ackedIDs, m.ID)
+				}
+				if ack || ackFirst {
+					stats.Incr("acks", 1)
 				}
-			case <-time.After(1 * time.Second):
+				switch {
+				case ackFirst:
+					// Already acked; just release it from the iterator.
+					m.Done(false)
+				case batcher != nil:
+					batcher.Add(m)
+				case ack:
+					m.Done(true)
+				default:
+					m.Done(false)
+				}
+				if v != duplicate {
+					i0++
+					bar.Update(i0)
+					stats.Incr("messages", 1)
+				}
+			case now := <-beat:
 				log.Debugf("subscription heartbeat")
-				stop := time.Now()
-				log.Infof("Processed %d in %v", (i0 - i1), stop.Sub(start))
+				if out != nil {
+					if err := out.Flush(); err != nil {
+						log.Errorf("error flushing output: %v", err)
+					}
+				}
+				ackedIDs = logAckedIDs(ackedIDs)
+				if noHeartbeat {
+					// Keep flushing, but leave throughput to the final summary.
+					break
+				}
+				interval := now.Sub(lastBeat)
+				rate := float64(i0-i1) / interval.Seconds()
+				log.Infof("Processed %d in %v: %f msgs/s", (i0 - i1), interval, rate)
+				st.belowRate = minRate > 0 && rate < minRate
+				if st.belowRate {
+					log.Warnf("throughput %f msgs/s below minimum %f msgs/s", rate, minRate)
+				}
 				i1 = i0
+				lastBeat = now
+			case <-batchTick:
+				batcher.Flush()
+			case <-flushTick:
+				if err := out.Flush(); err != nil {
+					log.Errorf("error flushing output: %v", err)
+				}
+				if err := stream.Flush(); err != nil {
+					log.Errorf("error flushing output: %v", err)
+				}
+			case <-idle:
+				log.Warnf("no messages received in %v", pullTimeout)
+				st.idle = true
+				if !exitOnIdle {
+					idleTimer.Reset(pullTimeout)
+				}
+			case <-finished:
+				st.finished = true
+			case <-gaveUp:
+				log.Errorf("giving up after %d reconnection attempts: %v", reconnectMax, pullErr)
+				st.gaveUp = true
+			case <-ctx.Done():
+				// Seen by shouldStop.
 			}
-			if shouldQuit(quit) || i0 >= numConsume {
+			st.consumed = i0
+			if done, c, reason := shouldStop(st); done {
+				code = c
+				bar.Done()
 				stop := time.Now()
-				log.Infof("Final Processed %d in %v", (i0 - i1), stop.Sub(start))
-				delta := i0 - i1
+				log.WithField("reason", reason.String()).Infof("Final Processed %d in %v, stopped by %v", i0, stop.Sub(start), reason)
 				secs := stop.Sub(start).Seconds()
-				log.Infof("%f msgs/s", float64(delta)/secs)
+				log.Infof("%f msgs/s", float64(i0)/secs)
 				break
 			}
 		}
 
-		os.Exit(0)
+		// Flush pending acks before stopping the iterator, which blocks
+		// until every message it returned has been marked Done.
+		close(stopping)
+		logAckedIDs(ackedIDs)
+		closeOut()
+		if batcher != nil {
+			batcher.Flush()
+		}
+		it.Stop()
+
+		if attrKeys != nil {
+			printAttributeKeys(attrKeys)
+		}
+		if chunks != nil && chunks.Pending() > 0 {
+			log.Warnf("%d chunked payloads were incomplete at exit", chunks.Pending())
+		}
+		if countOutput {
+			fmt.Println(i0)
+		}
+		if !checkExpectMin(i0) && code == 0 {
+			code = 1
+		}
+		stats.Close()
+		os.Exit(code)
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(subCmd)
 	subCmd.PersistentFlags().StringVar(&subscription, "sub", "", "PubSub subscription")
+	subCmd.PersistentFlags().BoolVar(&subAutocreate, "sub-autocreate", false, "Create the subscription to --topic if it doesn't exist")
+	subCmd.PersistentFlags().DurationVar(&subAckDeadline, "ack-deadline", time.Minute, "Ack deadline of a subscription created by --sub-autocreate, from 10s to 10m")
 	subCmd.PersistentFlags().IntVar(&numConsume, "num", 10, "Messages to consume")
 	subCmd.PersistentFlags().BoolVar(&ack, "ack", false, "ACK messages")
+	subCmd.PersistentFlags().BoolVar(&dropExpired, "drop-expired", false, "Ack and skip messages whose expires-at attribute has passed")
+	subCmd.PersistentFlags().BoolVar(&ackFirst, "ack-first", false, "Ack each message before processing it: at-most-once, so a crash loses it rather than redelivering it")
+	subCmd.PersistentFlags().BoolVar(&countOutput, "count-output", false, "Print only the number of messages consumed to stdout on exit; logs go to stderr")
+	subCmd.PersistentFlags().IntVar(&expectMin, "expect-min", 0, "Exit non-zero if fewer than this many messages were consumed")
+	subCmd.PersistentFlags().DurationVar(&startupJitter, "startup-jitter", 0, "Sleep a random duration up to this value before the first pull")
+	subCmd.PersistentFlags().StringVar(&outputFormat, "output", "", "write consumed messages to stdout: csv,json")
+	subCmd.PersistentFlags().BoolVar(&attributesOnly, "attributes-only", false, "write only message attributes, as JSON unless --output is set")
+	subCmd.PersistentFlags().Float64Var(&sampleRate, "sample-rate", 1, "fraction of messages written to --output; all are still acked and counted in rates")
+	subCmd.PersistentFlags().Int64Var(&sampleSeed, "sample-seed", 0, "seed for --sample-rate; 0 seeds from the clock")
+	subCmd.PersistentFlags().StringVar(&decodeMode, "decode", "", "auto: decode data by its content encoding attribute and write it as text, pretty printing JSON")
+	subCmd.PersistentFlags().StringVar(&decodeEncodingAttr, "decode-encoding-attr", "content-encoding", "attribute --decode reads the encoding from: gzip, base64 or identity")
+	subCmd.PersistentFlags().StringVar(&decodeTypeAttr, "decode-type-attr", "content-type", "attribute --decode reads the content type from")
+	subCmd.PersistentFlags().StringSliceVar(&redactAttrs, "redact-attr", nil, "attribute whose value is replaced with *** in output; repeatable")
+	subCmd.PersistentFlags().BoolVar(&printAttrKeys, "print-attributes-keys", false, "Report each attribute key seen and how many messages carried it on exit")
+	subCmd.PersistentFlags().StringVar(&outSocket, "out-socket", "", "write --output, json by default, to this Unix domain socket")
+	subCmd.PersistentFlags().DurationVar(&outSocketRetry, "out-socket-retry", 5*time.Second, "how long to keep reconnecting to --out-socket in an outage before writes fail")
+	subCmd.PersistentFlags().BoolVar(&outSocketNack, "out-socket-nack", false, "don't ack messages which couldn't be written, so they are redelivered")
+	subCmd.PersistentFlags().DurationVar(&flushInterval, "flush-interval", time.Second, "buffer --output and flush it at this interval and on exit; 0 writes unbuffered")
+	subCmd.PersistentFlags().StringVar(&verifyKey, "verify-key", "", "Nack messages whose signature attribute isn't the HMAC of their data with this key")
+	subCmd.PersistentFlags().StringVar(&hmacHash, "hmac-hash", "sha256", "Hash for --verify-key: sha1, sha256 or sha512")
+	subCmd.PersistentFlags().BoolVar(&reassemble, "reassemble", false, "Buffer chunks published by pub --chunk and write each payload once complete")
+	subCmd.PersistentFlags().StringVar(&outFile, "out-file", "", "write --output to this file instead of stdout")
+	subCmd.PersistentFlags().BoolVar(&gzipOut, "gzip-out", false, "gzip compress the --output stream")
+	subCmd.PersistentFlags().StringSliceVar(&csvAttrs, "csv-attrs", nil, "attributes written as columns by --output=csv")
+	subCmd.PersistentFlags().IntVar(&reconnectMax, "reconnect-max", 0, "Reconnection attempts after consecutive iterator errors; 0 logs errors and keeps pulling")
+	subCmd.PersistentFlags().DurationVar(&reconnectBase, "reconnect-base", time.Second, "Backoff ceiling before the first reconnection, doubling per attempt; each delay is random up to the ceiling")
+	subCmd.PersistentFlags().DurationVar(&reconnectMaxDelay, "reconnect-max-delay", 30*time.Second, "Cap on the backoff ceiling between reconnections")
+	subCmd.PersistentFlags().BoolVar(&peek, "peek", false, "Print up to --num available messages, as json unless --output is set, then release them unacked")
+	subCmd.PersistentFlags().BoolVar(&noWait, "no-wait", false, "Pull only the messages available now, up to --num, then exit")
+	subCmd.PersistentFlags().BoolVar(&probe, "probe", false, "Exit 0 if the subscription can be pulled from, non-zero otherwise, without consuming")
+	subCmd.PersistentFlags().DurationVar(&probeTimeout, "probe-timeout", 5*time.Second, "Timeout for --probe")
+	subCmd.PersistentFlags().StringVar(&subSequenceAttr, "sequence-attr", "", "Drop duplicate messages by the sequence number in this attribute")
+	subCmd.PersistentFlags().Int64Var(&sequenceWindowSize, "sequence-window", 10000, "Number of recent sequence numbers tracked by --sequence-attr")
+	subCmd.PersistentFlags().DurationVar(&heartbeat, "heartbeat", 10*time.Second, "Interval between throughput logs; 0 disables")
+	subCmd.PersistentFlags().BoolVar(&noHeartbeat, "no-heartbeat", false, "Don't log throughput each heartbeat, only the final summary")
+	subCmd.PersistentFlags().Float64Var(&minRate, "min-rate", 0, "Warn when a heartbeat interval's throughput in msgs/s is below this rate")
+	subCmd.PersistentFlags().BoolVar(&failBelowRate, "fail-below-rate", false, "Exit non-zero when throughput drops below --min-rate")
+	subCmd.PersistentFlags().DurationVar(&pullTimeout, "pull-timeout", 0, "Warn when no message arrives within this duration; 0 disables")
+	subCmd.PersistentFlags().BoolVar(&exitOnIdle, "exit-on-idle", false, "Exit with --idle-exit-code when --pull-timeout elapses without a message")
+	subCmd.PersistentFlags().IntVar(&idleExitCode, "idle-exit-code", 3, "Exit code for --exit-on-idle, distinct from errors so orchestrators can scale down")
+	subCmd.PersistentFlags().BoolVar(&logAcks, "log-acks", false, "Log the IDs of acked messages once per heartbeat")
+	statsdFlags(subCmd.PersistentFlags())
+	subCmd.PersistentFlags().IntVar(&ackBatchSize, "ack-batch-size", 0, "Acknowledge messages in batches of this size; 0 acks each message")
+	subCmd.PersistentFlags().DurationVar(&ackBatchWait, "ack-batch-wait", time.Second, "Acknowledge a partial --ack-batch-size batch after this long")
 }
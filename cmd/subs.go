@@ -0,0 +1,472 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+var (
+	// describeOutput is the output format of the describe commands.
+	describeOutput string
+	pushEndpoint   string
+	deleteYes      bool
+	deleteDryRun   bool
+	// exportFile is where the export commands write, stdout when empty.
+	exportFile   string
+	importFile   string
+	importDryRun bool
+)
+
+// subscriptionDescription is the configuration reported by subs describe.
+type subscriptionDescription struct {
+	Name           string            `json:"name"`
+	Topic          string            `json:"topic"`
+	AckDeadline    string            `json:"ackDeadline"`
+	PushEndpoint   string            `json:"pushEndpoint,omitempty"`
+	PushAttributes map[string]string `json:"pushAttributes,omitempty"`
+}
+
+// describeSubscription gathers the configuration of the named subscription.
+func describeSubscription(ctx context.Context, client *pubsub.Client, name string) (*subscriptionDescription, error) {
+	sub := client.Subscription(name)
+	conf, err := sub.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &subscriptionDescription{
+		Name:           sub.Name(),
+		Topic:          conf.Topic.Name(),
+		AckDeadline:    conf.AckDeadline.String(),
+		PushEndpoint:   conf.PushConfig.Endpoint,
+		PushAttributes: conf.PushConfig.Attributes,
+	}, nil
+}
+
+// printSubscription writes d to stdout in the describeOutput format.
+func printSubscription(d *subscriptionDescription) {
+	if describeOutput == "json" {
+		printJSON(d)
+		return
+	}
+	fmt.Printf("name:           %s\n", d.Name)
+	fmt.Printf("topic:          %s\n", d.Topic)
+	fmt.Printf("ackDeadline:    %s\n", d.AckDeadline)
+	fmt.Printf("pushEndpoint:   %s\n", d.PushEndpoint)
+	for k, v := range d.PushAttributes {
+		fmt.Printf("  %s=%s\n", k, v)
+	}
+}
+
+// confirm asks the user to confirm prompt on stdin, returning true for y or yes.
+func confirm(prompt string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", prompt)
+	var answer string
+	fmt.Scanln(&answer)
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Errorf("error marshaling output: %v", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(b))
+}
+
+// exportJSON writes v as indented JSON to exportFile, or to stdout when
+// exportFile is empty.
+func exportJSON(v interface{}) {
+	if exportFile == "" {
+		printJSON(v)
+		return
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Errorf("error marshaling output: %v", err)
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(exportFile, append(b, '\n'), 0644); err != nil {
+		log.Errorf("error writing %s: %v", exportFile, err)
+		os.Exit(1)
+	}
+	log.Infof("Wrote %s", exportFile)
+}
+
+// readSubscriptionDescriptions reads a subscription written by subs export,
+// or a JSON array of them, from path.
+func readSubscriptionDescriptions(path string) ([]*subscriptionDescription, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ds []*subscriptionDescription
+	if err := json.Unmarshal(b, &ds); err == nil {
+		return ds, nil
+	}
+	var d subscriptionDescription
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return []*subscriptionDescription{&d}, nil
+}
+
+// resourceName returns the short name of full, which may be qualified as
+// projects/<project>/<kind>/<name>, checking it belongs to project.
+func resourceName(full, kind, project string) (string, error) {
+	parts := strings.Split(full, "/")
+	if len(parts) == 1 && full != "" {
+		return full, nil
+	}
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != kind || parts[3] == "" {
+		return "", fmt.Errorf("invalid %s name %q", kind, full)
+	}
+	if parts[1] != project {
+		return "", fmt.Errorf("%s %q is not in project %s", kind, full, project)
+	}
+	return parts[3], nil
+}
+
+// deletedTopic is the topic reported for a subscription whose topic was
+// deleted.
+const deletedTopic = "_deleted-topic_"
+
+// verifyBinding checks the subscription described by d is attached to the
+// topic with the full name topic.
+func verifyBinding(d *subscriptionDescription, topic string) error {
+	switch d.Topic {
+	case topic:
+		return nil
+	case deletedTopic:
+		return fmt.Errorf("subscription %s is attached to a deleted topic, expected %s", d.Name, topic)
+	default:
+		return fmt.Errorf("subscription %s is attached to %s, expected %s", d.Name, d.Topic, topic)
+	}
+}
+
+// importSubscription creates the subscription described by d if it doesn't
+// exist, or updates its push config to match d if it does, returning
+// created, updated or unchanged. With dryRun the changes are only printed.
+func importSubscription(ctx context.Context, client *pubsub.Client, d *subscriptionDescription, dryRun bool) (string, error) {
+	name, err := resourceName(d.Name, "subscriptions", Gceproject)
+	if err != nil {
+		return "", err
+	}
+	topicName, err := resourceName(d.Topic, "topics", Gceproject)
+	if err != nil {
+		return "", err
+	}
+	var ackDeadline time.Duration
+	if d.AckDeadline != "" {
+		if ackDeadline, err = time.ParseDuration(d.AckDeadline); err != nil {
+			return "", fmt.Errorf("invalid ackDeadline %q: %v", d.AckDeadline, err)
+		}
+	}
+	push := pubsub.PushConfig{Endpoint: d.PushEndpoint, Attributes: d.PushAttributes}
+
+	ok, err := client.Subscription(name).Exists(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		if dryRun {
+			fmt.Printf("+ %s: topic %s, ackDeadline %s, pushEndpoint %q\n", name, topicName, d.AckDeadline, d.PushEndpoint)
+			return "created", nil
+		}
+		var pc *pubsub.PushConfig
+		if push.Endpoint != "" {
+			pc = &push
+		}
+		if _, err := client.NewSubscription(ctx, name, client.Topic(topicName), ackDeadline, pc); err != nil {
+			return "", err
+		}
+		return "created", nil
+	}
+
+	cur, err := describeSubscription(ctx, client, name)
+	if err != nil {
+		return "", err
+	}
+	if cur.Topic != client.Topic(topicName).Name() {
+		return "", fmt.Errorf("topic can't be changed from %s; delete and re-import %s", cur.Topic, name)
+	}
+	if ackDeadline != 0 && cur.AckDeadline != ackDeadline.String() {
+		log.Warnf("%s: ackDeadline can't be updated, keeping %s", name, cur.AckDeadline)
+	}
+	attrsChanged := (len(cur.PushAttributes) > 0 || len(d.PushAttributes) > 0) &&
+		!reflect.DeepEqual(cur.PushAttributes, d.PushAttributes)
+	if cur.PushEndpoint == d.PushEndpoint && !attrsChanged {
+		return "unchanged", nil
+	}
+	if dryRun {
+		fmt.Printf("~ %s: pushEndpoint %q -> %q\n", name, cur.PushEndpoint, d.PushEndpoint)
+		if attrsChanged {
+			fmt.Printf("~ %s: pushAttributes %v -> %v\n", name, cur.PushAttributes, d.PushAttributes)
+		}
+		return "updated", nil
+	}
+	if err := client.Subscription(name).ModifyPushConfig(ctx, &push); err != nil {
+		return "", err
+	}
+	return "updated", nil
+}
+
+// subsCmd represents the subs command
+var subsCmd = &cobra.Command{
+	Use:   "subs",
+	Short: "Manage subscriptions",
+	Long:  `Inspect and manage the subscriptions of a project.`,
+}
+
+// subsDescribeCmd represents the subs describe command
+var subsDescribeCmd = &cobra.Command{
+	Use:   "describe <name>",
+	Short: "Print the configuration of a subscription",
+	Long:  `Print the configuration of a subscription, including its topic, ack deadline and push config, as text or JSON.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("subscription name must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		d, err := describeSubscription(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing subscription %s: %v", args[0], err)
+			os.Exit(1)
+		}
+
+		printSubscription(d)
+	},
+}
+
+// subsUpdateCmd represents the subs update command
+var subsUpdateCmd = &cobra.Command{
+	Use:   "update <name>",
+	Short: "Update the configuration of a subscription",
+	Long: `Update the configuration of a subscription and print the result.
+Only fields whose flags are given are changed. An empty --push-endpoint
+switches the subscription to pull delivery.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("subscription name must be given")
+			os.Exit(1)
+		}
+		if !cmd.Flags().Changed("push-endpoint") {
+			log.Errorf("no fields to update")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		cur, err := describeSubscription(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing subscription %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		// The push config is replaced whole, so carry the existing
+		// attributes over to the new endpoint.
+		pc := &pubsub.PushConfig{Endpoint: pushEndpoint}
+		if pushEndpoint != "" {
+			pc.Attributes = cur.PushAttributes
+		}
+		sub := psClient.Subscription(args[0])
+		if err := sub.ModifyPushConfig(ctx, pc); err != nil {
+			log.Errorf("error updating push config of %s: %v", args[0], err)
+			os.Exit(1)
+		}
+
+		d, err := describeSubscription(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing subscription %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		printSubscription(d)
+	},
+}
+
+// subsDeleteCmd represents the subs delete command
+var subsDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a subscription",
+	Long: `Delete a subscription after confirmation, or without prompting with --yes.
+--dry-run reports what would be deleted without deleting anything.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("subscription name must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		d, err := describeSubscription(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing subscription %s: %v", args[0], err)
+			os.Exit(1)
+		}
+
+		if deleteDryRun {
+			fmt.Printf("would delete subscription %s of topic %s\n", d.Name, d.Topic)
+			return
+		}
+		if !deleteYes && !confirm(fmt.Sprintf("Delete subscription %s?", d.Name)) {
+			log.Infof("Not deleting %s", d.Name)
+			return
+		}
+		if err := psClient.Subscription(args[0]).Delete(ctx); err != nil {
+			log.Errorf("error deleting subscription %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		log.Infof("Deleted subscription %s", d.Name)
+	},
+}
+
+// subsExportCmd represents the subs export command
+var subsExportCmd = &cobra.Command{
+	Use:   "export <name>",
+	Short: "Export the configuration of a subscription as JSON",
+	Long: `Write the full configuration of a subscription as JSON to stdout or --file,
+in the format read by subs import.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("subscription name must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		d, err := describeSubscription(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing subscription %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		exportJSON(d)
+	},
+}
+
+// subsVerifyCmd represents the subs verify command
+var subsVerifyCmd = &cobra.Command{
+	Use:   "verify <name>",
+	Short: "Check a subscription is attached to the expected topic",
+	Long: `Check the subscription is attached to --topic, exiting non-zero with the
+topic it's actually attached to if not. Useful as a preflight check in CI.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("subscription name must be given")
+			os.Exit(1)
+		}
+		if Topic == "" {
+			log.Errorf("--topic must be given")
+			os.Exit(1)
+		}
+		topicName, err := resourceName(Topic, "topics", Gceproject)
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		d, err := describeSubscription(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing subscription %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		if err := verifyBinding(d, psClient.Topic(topicName).Name()); err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		fmt.Printf("subscription %s is attached to %s\n", d.Name, d.Topic)
+	},
+}
+
+// subsImportCmd represents the subs import command
+var subsImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Create or update subscriptions from exported JSON",
+	Long: `Read subscriptions written by subs export, one or a JSON array of them, from
+--file and make the project match: absent subscriptions are created and the
+push config of existing ones is updated. The topic and ack deadline of an
+existing subscription can't be changed by this client. --dry-run prints the
+changes without applying them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if importFile == "" {
+			log.Errorf("--file must be given")
+			os.Exit(1)
+		}
+		ds, err := readSubscriptionDescriptions(importFile)
+		if err != nil {
+			log.Errorf("error reading %s: %v", importFile, err)
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		counts := map[string]int{}
+		for _, d := range ds {
+			result, err := importSubscription(ctx, psClient, d, importDryRun)
+			if err != nil {
+				log.Errorf("error importing subscription %s: %v", d.Name, err)
+				result = "failed"
+			}
+			counts[result]++
+		}
+		log.Infof("Created %d, updated %d, unchanged %d, failed %d",
+			counts["created"], counts["updated"], counts["unchanged"], counts["failed"])
+		if counts["failed"] > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(subsCmd)
+	subsCmd.AddCommand(subsDescribeCmd)
+	subsCmd.AddCommand(subsUpdateCmd)
+	subsCmd.AddCommand(subsDeleteCmd)
+	subsCmd.AddCommand(subsExportCmd)
+	subsCmd.AddCommand(subsImportCmd)
+	subsCmd.AddCommand(subsVerifyCmd)
+
+	subsDescribeCmd.Flags().StringVar(&describeOutput, "output", "text", "output format: text,json")
+	subsUpdateCmd.Flags().StringVar(&describeOutput, "output", "text", "output format: text,json")
+	subsDeleteCmd.Flags().BoolVar(&deleteYes, "yes", false, "Delete without asking for confirmation")
+	subsDeleteCmd.Flags().BoolVar(&deleteDryRun, "dry-run", false, "Report what would be deleted without deleting")
+	subsImportCmd.Flags().StringVar(&importFile, "file", "", "JSON file written by subs export")
+	subsImportCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "Print the changes without applying them")
+	subsExportCmd.Flags().StringVar(&exportFile, "file", "", "write to this file instead of stdout")
+	subsUpdateCmd.Flags().StringVar(&pushEndpoint, "push-endpoint", "", "URL to push messages to; empty for pull delivery")
+}
@@ -0,0 +1,88 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// maxTokenLifetime is how long Google access tokens are issued for;
+// --token-refresh-early must be shorter.
+const maxTokenLifetime = time.Hour
+
+// tokenRetry is how long earlyRefreshSource keeps using its token after a
+// refresh which left it inside the early window.
+var tokenRetry = 10 * time.Second
+
+// earlyRefreshSource caches a token and replaces it once it is within early
+// of expiring. The oauth2 token sources already cache, but only refresh 10s
+// before expiry, which long drains behind slow proxies can miss.
+//
+// newSource must return a fresh source each call; reusing one would hand
+// back its own cached token rather than fetching a new one. Some sources,
+// like the GCE metadata server, cache anyway and return the current token
+// until shortly before it expires.
+type earlyRefreshSource struct {
+	mu        sync.Mutex
+	early     time.Duration
+	newSource func() (oauth2.TokenSource, error)
+	tok       *oauth2.Token
+	// retry holds off refreshing again until then.
+	retry time.Time
+}
+
+func newEarlyRefreshSource(early time.Duration, newSource func() (oauth2.TokenSource, error)) oauth2.TokenSource {
+	return &earlyRefreshSource{early: early, newSource: newSource}
+}
+
+// Token returns the cached token, refreshing it first if it expires
+// within the early window. A refresh which doesn't advance the expiry
+// keeps the current token, and one still inside the window is retried only
+// after tokenRetry, so the token endpoint isn't called on every request.
+func (s *earlyRefreshSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.tok.Valid() && (s.tok.Expiry.IsZero() || now.Add(s.early).Before(s.tok.Expiry) || now.Before(s.retry)) {
+		return s.tok, nil
+	}
+
+	src, err := s.newSource()
+	if err != nil {
+		return nil, err
+	}
+	tok, err := src.Token()
+	if err != nil {
+		log.Debugf("oauth token refresh failed: %v", err)
+		return nil, err
+	}
+	if s.tok.Valid() && !tok.Expiry.After(s.tok.Expiry) {
+		log.Debugf("oauth token source returned the current token, expires %v", s.tok.Expiry)
+		s.retry = now.Add(tokenRetry)
+		return s.tok, nil
+	}
+	log.Debugf("oauth token refreshed, expires %v", tok.Expiry)
+	if !tok.Expiry.IsZero() && !now.Add(s.early).Before(tok.Expiry) {
+		log.Warnf("oauth token expires %v, within --token-refresh-early %v", tok.Expiry, s.early)
+		s.retry = now.Add(tokenRetry)
+	}
+	s.tok = tok
+	return tok, nil
+}
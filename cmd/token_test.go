@@ -0,0 +1,78 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeTokens returns a newSource func handing out toks in order, the last
+// one repeatedly, and a count of the sources created.
+func fakeTokens(toks ...*oauth2.Token) (func() (oauth2.TokenSource, error), *int) {
+	calls := 0
+	return func() (oauth2.TokenSource, error) {
+		tok := toks[len(toks)-1]
+		if calls < len(toks) {
+			tok = toks[calls]
+		}
+		calls++
+		return oauth2.StaticTokenSource(tok), nil
+	}, &calls
+}
+
+func TestEarlyRefreshSource(t *testing.T) {
+	defer func(d time.Duration) { tokenRetry = d }(tokenRetry)
+
+	now := time.Now()
+	token := func(name string, expiresIn time.Duration) *oauth2.Token {
+		return &oauth2.Token{AccessToken: name, Expiry: now.Add(expiresIn)}
+	}
+	tests := []struct {
+		name      string
+		retry     time.Duration
+		toks      []*oauth2.Token
+		calls     int
+		want      string
+		wantFetch int
+	}{
+		{"cached", time.Hour, []*oauth2.Token{token("a", time.Hour)}, 3, "a", 1},
+		{"refreshed", 0, []*oauth2.Token{token("a", 5*time.Minute), token("b", time.Hour)}, 3, "b", 2},
+		// The source keeps returning a token inside the window.
+		{"held off", time.Hour, []*oauth2.Token{token("a", 5*time.Minute)}, 3, "a", 1},
+		{"not advanced", 0, []*oauth2.Token{token("a", 5*time.Minute)}, 3, "a", 3},
+		{"went back", 0, []*oauth2.Token{token("a", 5*time.Minute), token("b", time.Minute)}, 2, "a", 2},
+	}
+	for _, tt := range tests {
+		tokenRetry = tt.retry
+		newSource, fetched := fakeTokens(tt.toks...)
+		src := newEarlyRefreshSource(10*time.Minute, newSource)
+		var tok *oauth2.Token
+		for i := 0; i < tt.calls; i++ {
+			var err error
+			if tok, err = src.Token(); err != nil {
+				t.Fatalf("%s: Token: %v", tt.name, err)
+			}
+		}
+		if tok.AccessToken != tt.want {
+			t.Errorf("%s: Token = %s, want %s", tt.name, tok.AccessToken, tt.want)
+		}
+		if *fetched != tt.wantFetch {
+			t.Errorf("%s: fetched %d tokens, want %d", tt.name, *fetched, tt.wantFetch)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/pubsub"
+)
+
+// topicDescription is the configuration reported by topics describe.
+type topicDescription struct {
+	Name          string   `json:"name"`
+	Subscriptions []string `json:"subscriptions"`
+}
+
+// describeTopic gathers the configuration of the named topic.
+func describeTopic(ctx context.Context, client *pubsub.Client, name string) (*topicDescription, error) {
+	topic := client.Topic(name)
+	ok, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("topic %s does not exist", name)
+	}
+
+	d := &topicDescription{Name: topic.Name(), Subscriptions: []string{}}
+	subs := topic.Subscriptions(ctx)
+	for {
+		sub, err := subs.Next()
+		if err == pubsub.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.Subscriptions = append(d.Subscriptions, sub.Name())
+	}
+	return d, nil
+}
+
+// waitForTopicReady polls every second until the named topic exists, giving
+// up after WaitForTopic. It returns straight away when WaitForTopic is 0.
+func waitForTopicReady(ctx context.Context, client *pubsub.Client, name string) error {
+	if WaitForTopic <= 0 {
+		return nil
+	}
+	topic := client.Topic(name)
+	deadline := time.After(WaitForTopic)
+	for {
+		ok, err := topic.Exists(ctx)
+		if err != nil {
+			log.Debugf("error checking topic %s: %v", name, err)
+		} else if ok {
+			log.Infof("Topic %s exists", name)
+			return nil
+		} else {
+			log.Debugf("Waiting for topic %s", name)
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-deadline:
+			return fmt.Errorf("topic %s not found within %v", name, WaitForTopic)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+var countWindow time.Duration
+
+// countTopic subscribes a temporary subscription to the named topic and
+// counts the messages it receives within window. The subscription is always
+// deleted before returning, even if ctx is cancelled.
+func countTopic(ctx context.Context, client *pubsub.Client, name string, window time.Duration) (int, error) {
+	topic := client.Topic(name)
+	subName := "pubbing-count-" + uuid.New()
+	sub, err := client.NewSubscription(ctx, subName, topic, 0, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating temporary subscription: %v", err)
+	}
+	log.Debugf("Created temporary subscription %s", subName)
+	defer func() {
+		// Use a fresh context so cleanup still happens after a signal.
+		if err := sub.Delete(context.Background()); err != nil {
+			log.Errorf("error deleting temporary subscription %s: %v", subName, err)
+			return
+		}
+		log.Debugf("Deleted temporary subscription %s", subName)
+	}()
+
+	wctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+	it, err := sub.Pull(wctx)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Stop()
+
+	n := 0
+	for {
+		m, err := it.Next()
+		if err != nil {
+			if wctx.Err() != nil || err == pubsub.Done {
+				return n, nil
+			}
+			return n, err
+		}
+		m.Done(true)
+		n++
+	}
+}
+
+// topicsCmd represents the topics command
+var topicsCmd = &cobra.Command{
+	Use:   "topics",
+	Short: "Manage topics",
+	Long:  `Inspect and manage the topics of a project.`,
+}
+
+// topicsDescribeCmd represents the topics describe command
+var topicsDescribeCmd = &cobra.Command{
+	Use:   "describe <name>",
+	Short: "Print the configuration of a topic",
+	Long:  `Print the configuration of a topic, including its subscriptions, as text or JSON.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("topic name must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		d, err := describeTopic(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing topic %s: %v", args[0], err)
+			os.Exit(1)
+		}
+
+		if describeOutput == "json" {
+			printJSON(d)
+			return
+		}
+		fmt.Printf("name:           %s\n", d.Name)
+		fmt.Printf("subscriptions:\n")
+		for _, s := range d.Subscriptions {
+			fmt.Printf("  %s\n", s)
+		}
+	},
+}
+
+// topicsDeleteCmd represents the topics delete command
+var topicsDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a topic",
+	Long: `Delete a topic after confirmation, or without prompting with --yes.
+Subscriptions to a deleted topic are orphaned and stop receiving messages.
+--dry-run reports what would be deleted without deleting anything.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("topic name must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		d, err := describeTopic(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing topic %s: %v", args[0], err)
+			os.Exit(1)
+		}
+
+		if deleteDryRun {
+			fmt.Printf("would delete topic %s, orphaning %d subscriptions\n", d.Name, len(d.Subscriptions))
+			for _, s := range d.Subscriptions {
+				fmt.Printf("  %s\n", s)
+			}
+			return
+		}
+		prompt := fmt.Sprintf("Delete topic %s, orphaning %d subscriptions?", d.Name, len(d.Subscriptions))
+		if !deleteYes && !confirm(prompt) {
+			log.Infof("Not deleting %s", d.Name)
+			return
+		}
+		if err := psClient.Topic(args[0]).Delete(ctx); err != nil {
+			log.Errorf("error deleting topic %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		log.Infof("Deleted topic %s", d.Name)
+	},
+}
+
+// topicsExportCmd represents the topics export command
+var topicsExportCmd = &cobra.Command{
+	Use:   "export <name>",
+	Short: "Export the configuration of a topic as JSON",
+	Long:  `Write the configuration of a topic, including its subscriptions, as JSON to stdout or --file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("topic name must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		d, err := describeTopic(ctx, psClient, args[0])
+		if err != nil {
+			log.Errorf("error describing topic %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		exportJSON(d)
+	},
+}
+
+// topicsCountCmd represents the topics count command
+var topicsCountCmd = &cobra.Command{
+	Use:   "count <name>",
+	Short: "Approximately count messages flowing through a topic",
+	Long: `Create a temporary subscription to a topic, drain and count the messages
+it receives within --window, then delete it. A new subscription only sees
+messages published after it was created, so the result is an approximate
+reading of the topic's traffic over the window rather than an exact depth.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if len(args) != 1 {
+			log.Errorf("topic name must be given")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		n, err := countTopic(ctx, psClient, args[0], countWindow)
+		if err != nil {
+			log.Errorf("error counting topic %s: %v", args[0], err)
+			os.Exit(1)
+		}
+		fmt.Printf("~%d messages on %s in %v (approximate)\n", n, args[0], countWindow)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(topicsCmd)
+	topicsCmd.AddCommand(topicsDescribeCmd)
+	topicsCmd.AddCommand(topicsDeleteCmd)
+	topicsCmd.AddCommand(topicsCountCmd)
+	topicsCmd.AddCommand(topicsExportCmd)
+
+	topicsDescribeCmd.Flags().StringVar(&describeOutput, "output", "text", "output format: text,json")
+	topicsDeleteCmd.Flags().BoolVar(&deleteYes, "yes", false, "Delete without asking for confirmation")
+	topicsExportCmd.Flags().StringVar(&exportFile, "file", "", "write to this file instead of stdout")
+	topicsCountCmd.Flags().DurationVar(&countWindow, "window", 10*time.Second, "How long to count messages for")
+	topicsDeleteCmd.Flags().BoolVar(&deleteDryRun, "dry-run", false, "Report what would be deleted without deleting")
+}
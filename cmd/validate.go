@@ -0,0 +1,149 @@
+// Copyright © 2016 Josh Roppo joshroppo@gmail.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var validateFor string
+
+// checklist prints the pass/fail result of each validation check.
+type checklist struct {
+	failed int
+}
+
+// check prints the result of the named check and reports whether it passed.
+func (c *checklist) check(name string, err error) bool {
+	if err != nil {
+		c.failed++
+		fmt.Printf("[FAIL] %s: %v\n", name, err)
+		return false
+	}
+	fmt.Printf("[PASS] %s\n", name)
+	return true
+}
+
+// skip prints a check which couldn't run because an earlier one failed.
+func (c *checklist) skip(name string) {
+	fmt.Printf("[SKIP] %s\n", name)
+}
+
+// required returns an error if the flag value v is empty.
+func required(flag, v string) error {
+	if v == "" {
+		return fmt.Errorf("--%s is not set", flag)
+	}
+	return nil
+}
+
+// checkPermission returns an error unless perm is granted on the resource.
+func checkPermission(resource, name, perm string) error {
+	report, err := testIamPermissions(resource, name, []string{perm})
+	if err != nil {
+		return err
+	}
+	if !report[0].Granted {
+		return fmt.Errorf("%s not granted", perm)
+	}
+	return nil
+}
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the configuration for pub or sub without sending traffic",
+	Long: `Checks that the flags are consistent, the credentials work, the topic (and
+for --for sub the subscription) exist, and the identity has the IAM
+permission the operation needs. Prints a pass/fail checklist and exits
+non-zero if any check fails.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logsetup()
+		if validateFor != "pub" && validateFor != "sub" {
+			log.Errorf("--for must be pub or sub")
+			os.Exit(1)
+		}
+		forSub := validateFor == "sub"
+
+		c := &checklist{}
+		configured := c.check("project set", required("project", Gceproject))
+		configured = c.check("topic set", required("topic", Topic)) && configured
+		if forSub {
+			configured = c.check("subscription set", required("sub", subscription)) && configured
+		}
+		var certErr error
+		if (ClientCert == "") != (ClientKey == "") {
+			certErr = errors.New("--client-cert and --client-key must be given together")
+		}
+		configured = c.check("client certificate flags", certErr) && configured
+
+		if !configured {
+			c.skip("credentials")
+			c.skip("topic exists")
+			if forSub {
+				c.skip("subscription exists")
+			}
+			c.skip("permissions")
+			os.Exit(1)
+		}
+
+		ctx := rootCtx
+		psClient := clientInit(&ctx)
+		topic := psClient.Topic(Topic)
+		ok, err := topic.Exists(ctx)
+		credentials := c.check("credentials", err)
+		if !credentials {
+			c.skip("topic exists")
+		} else if !ok {
+			c.check("topic exists", fmt.Errorf("topic %s not found", Topic))
+		} else {
+			c.check("topic exists", nil)
+		}
+
+		switch {
+		case !credentials:
+			if forSub {
+				c.skip("subscription exists")
+			}
+			c.skip("permissions")
+		case forSub:
+			var subErr error
+			if d, err := describeSubscription(ctx, psClient, subscription); err != nil {
+				subErr = err
+			} else if d.Topic != topic.Name() {
+				subErr = fmt.Errorf("subscription %s is on %s, not %s", subscription, d.Topic, topic.Name())
+			}
+			c.check("subscription exists", subErr)
+			c.check("permissions", checkPermission("sub", subscription, "pubsub.subscriptions.consume"))
+		default:
+			c.check("permissions", checkPermission("topic", Topic, "pubsub.topics.publish"))
+		}
+
+		if c.failed > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(validateCmd)
+	validateCmd.Flags().StringVar(&validateFor, "for", "pub", "operation to validate: pub,sub")
+	validateCmd.Flags().StringVar(&subscription, "sub", "", "PubSub subscription")
+}